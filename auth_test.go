@@ -0,0 +1,68 @@
+package oppositus_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"eagain.net/go/oppositus"
+	"eagain.net/go/oppositus/channels"
+	"eagain.net/go/oppositus/internal/httpclient"
+	"golang.org/x/net/context"
+)
+
+func TestMirrorAuth(t *testing.T) {
+	srv := newUpstream(t, upstreamFiles(t))
+	defer srv.Close()
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu     sync.Mutex
+		denied []string
+	)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	private := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if user, pass, ok := req.BasicAuth(); !ok || user != "mirror" || pass != "secret" {
+			mu.Lock()
+			denied = append(denied, req.Method+" "+req.URL.Path)
+			mu.Unlock()
+			http.Error(w, "who are you", http.StatusUnauthorized)
+			return
+		}
+		proxy.ServeHTTP(w, req)
+	}))
+	defer private.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	client, err := httpclient.New(httpclient.Options{
+		Upstreams: []httpclient.Upstream{
+			{URL: private.URL + "/", Auth: httpclient.Auth{Username: "mirror", Password: "secret"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(private.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+		oppositus.WithVersions(testVersion),
+		oppositus.WithHTTPClient(client),
+	)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	if len(denied) > 0 {
+		t.Errorf("requests without credentials: %q", denied)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "amd64-usr", "all", testVersion, "version.txt")); err != nil {
+		t.Errorf("not mirrored: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package oppositus
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"eagain.net/go/oppositus/channels"
+)
+
+// defaultBaseURL is where CoreOS publishes its releases. Every
+// channel has its own host, with a subdirectory per board.
+const defaultBaseURL = "http://{channel}.release.core-os.net/{board}/"
+
+// defaultBoard is the board mirrored if none are given.
+const defaultBoard = "amd64-usr"
+
+const (
+	channelPlaceholder = "{channel}"
+	boardPlaceholder   = "{board}"
+)
+
+// urlTemplate is a URL with placeholders, such as "{channel}", that
+// are replaced to get the URL of a release channel on a board.
+type urlTemplate string
+
+func parseURLTemplate(s string) (urlTemplate, error) {
+	if !strings.Contains(s, channelPlaceholder) {
+		return "", fmt.Errorf("base URL must contain %s: %q", channelPlaceholder, s)
+	}
+	t := urlTemplate(s)
+	// catch syntax errors early, instead of on first use
+	u, err := t.channel(defaultBoard, channels.Stable)
+	if err != nil {
+		return "", err
+	}
+	if !u.IsAbs() {
+		return "", fmt.Errorf("base URL must be absolute: %q", s)
+	}
+	return t, nil
+}
+
+// hasBoard reports whether the template can tell boards apart.
+func (t urlTemplate) hasBoard() bool {
+	return strings.Contains(string(t), boardPlaceholder)
+}
+
+// channel returns the URL of the release channel for the board. The
+// returned URL always ends in a slash, so relative references resolve
+// under it.
+func (t urlTemplate) channel(board string, channel channels.Channel) (*url.URL, error) {
+	s := strings.Replace(string(t), channelPlaceholder, channel.String(), -1)
+	s = strings.Replace(s, boardPlaceholder, board, -1)
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("bad base URL: %v", err)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, errors.New("base URL cannot have a query or fragment")
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return u, nil
+}
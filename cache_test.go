@@ -0,0 +1,73 @@
+package oppositus_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"eagain.net/go/oppositus"
+	"eagain.net/go/oppositus/channels"
+	"golang.org/x/net/context"
+)
+
+func TestMirrorNotModified(t *testing.T) {
+	srv := newUpstream(t, upstreamFiles(t))
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	opts := []oppositus.Option{
+		oppositus.WithBaseURL(srv.URL + "/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+	}
+	if _, err := oppositus.Mirror(context.Background(), dst, opts...); err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+
+	// change version.txt behind the server's back, so only a
+	// conditional request still sees the old version
+	p := filepath.Join(srv.dir, "stable", "current", "version.txt")
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := strings.Replace(string(readTestdata(t, "version.txt")), testVersion, "900.0.0", -1)
+	if err := ioutil.WriteFile(p, []byte(buf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(p, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := oppositus.Mirror(context.Background(), dst, opts...)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	if g, e := rep.Channels[0].Version, testVersion; g != e {
+		t.Errorf("cached version.txt not used: %q != %q", g, e)
+	}
+}
+
+func TestMirrorCacheUnwritable(t *testing.T) {
+	srv := newUpstream(t, upstreamFiles(t))
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+	// a file where the cache directory should be
+	if err := ioutil.WriteFile(filepath.Join(dst, ".cache"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+	)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	if g, e := rep.Channels[0].Version, testVersion; g != e {
+		t.Errorf("wrong version: %q != %q", g, e)
+	}
+}
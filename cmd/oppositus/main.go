@@ -1,37 +1,307 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"eagain.net/go/oppositus"
 	"eagain.net/go/oppositus/internal/config"
+	"eagain.net/go/oppositus/internal/httpclient"
 	"eagain.net/go/oppositus/internal/version"
+	"eagain.net/go/oppositus/s3"
+	"eagain.net/go/oppositus/sig"
 	"golang.org/x/net/context"
 )
 
 var (
 	showVersion = flag.Bool("version", false, "display version and exit")
+	dryRun      bool
+	report      = flag.String("report", "", "print a report of the run to stdout, as `FORMAT` text or json")
+	rateLimit   byteRate
 )
 
-func doit(configPath string, dest string) error {
+func init() {
+	const usage = "only show what would be downloaded"
+	flag.BoolVar(&dryRun, "n", false, usage)
+	flag.BoolVar(&dryRun, "dry-run", false, usage)
+	flag.Var(&rateLimit, "rate-limit", "limit download bandwidth to `BYTES` per second, with optional suffix K, M or G; overrides the config file")
+}
+
+// byteRate is a flag like "512K".
+type byteRate int64
+
+func (r *byteRate) String() string {
+	return strconv.FormatInt(int64(*r), 10)
+}
+
+func (r *byteRate) Set(s string) error {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return errors.New("must be a positive number of bytes")
+	}
+	*r = byteRate(n * mult)
+	return nil
+}
+
+// interruptible returns a context that is canceled on control-C.
+func interruptible() (context.Context, func()) {
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 
 	// jump through hoops to clean up temp files on control-C
-	signals := make(chan os.Signal)
+	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt)
-	defer close(signals)
-	defer signal.Stop(signals)
 	go func() {
-		<-signals
-		cancel()
+		if _, ok := <-signals; ok {
+			cancel()
+		}
 	}()
+	stop := func() {
+		signal.Stop(signals)
+		close(signals)
+		cancel()
+	}
+	return ctx, stop
+}
+
+// newClient makes the HTTP client described by the config file.
+func newClient(conf *config.Config) (*http.Client, error) {
+	ua := conf.HTTP.UserAgent
+	if ua == "" {
+		ua = prog + "/" + version.Version
+	}
+	upstreams, err := newUpstreams(conf.HTTP.Upstreams)
+	if err != nil {
+		return nil, err
+	}
+	return httpclient.New(httpclient.Options{
+		Proxy:                 conf.HTTP.Proxy,
+		ConnectTimeout:        time.Duration(conf.HTTP.ConnectTimeout) * time.Second,
+		ResponseHeaderTimeout: time.Duration(conf.HTTP.ResponseHeaderTimeout) * time.Second,
+		UserAgent:             ua,
+		Upstreams:             upstreams,
+	})
+}
+
+// newUpstreams reads the secrets of the upstreams in the config file.
+func newUpstreams(ups []config.Upstream) ([]httpclient.Upstream, error) {
+	var list []httpclient.Upstream
+	for _, up := range ups {
+		password, err := up.Auth.Password.Read()
+		if err != nil {
+			return nil, fmt.Errorf("password for %v: %v", up.URL, err)
+		}
+		token, err := up.Auth.Token.Read()
+		if err != nil {
+			return nil, fmt.Errorf("token for %v: %v", up.URL, err)
+		}
+		list = append(list, httpclient.Upstream{
+			URL: up.URL,
+			Auth: httpclient.Auth{
+				Username: up.Auth.Username,
+				Password: password,
+				Token:    token,
+			},
+			TLS: httpclient.TLS{
+				CAFile:     up.TLS.CAFile,
+				CertFile:   up.TLS.CertFile,
+				KeyFile:    up.TLS.KeyFile,
+				MinVersion: uint16(up.TLS.MinVersion),
+				PinnedSPKI: up.TLS.PinSHA256,
+			},
+		})
+	}
+	return list, nil
+}
+
+// seconds converts a number of seconds from the config file into a
+// duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// options converts the config file into options for the library.
+func options(conf *config.Config) ([]oppositus.Option, error) {
+	client, err := newClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	opts := []oppositus.Option{
+		oppositus.WithFilter(conf.Filters.Match),
+		oppositus.WithHTTPClient(client),
+	}
+	if conf.BaseURL != "" {
+		opts = append(opts, oppositus.WithBaseURL(conf.BaseURL))
+	}
+	if conf.Boards != nil {
+		opts = append(opts, oppositus.WithBoards(conf.Boards...))
+	}
+	if conf.Channels != nil {
+		opts = append(opts, oppositus.WithChannels(conf.Channels...))
+	}
+	if conf.Versions != nil {
+		opts = append(opts, oppositus.WithVersions(conf.Versions...))
+	}
+	if conf.Backfill != 0 {
+		opts = append(opts, oppositus.WithBackfill(conf.Backfill))
+	}
+	if conf.DigestedFiles {
+		opts = append(opts, oppositus.WithDigestedFiles(true))
+	}
+	if conf.PartialVersions {
+		opts = append(opts, oppositus.WithPartialVersions(true))
+	}
+	if len(conf.Trust.Keyrings) > 0 || len(conf.Trust.Keys) > 0 {
+		v, err := newVerifier(conf.Trust)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, oppositus.WithVerifier(v))
+	}
+	if conf.Quarantine.Dir != "" {
+		opts = append(opts, oppositus.WithQuarantine(conf.Quarantine.Dir, conf.Quarantine.MaxBytes))
+	}
+	if conf.Concurrency != 0 {
+		opts = append(opts, oppositus.WithConcurrency(conf.Concurrency))
+	}
+	limit := oppositus.RateLimit{
+		BytesPerSecond: conf.RateLimit.BytesPerSecond,
+	}
+	if rateLimit != 0 {
+		limit.BytesPerSecond = int64(rateLimit)
+	}
+	for _, w := range conf.RateLimit.Windows {
+		window := oppositus.TimeWindow{
+			Start: time.Duration(w.Start),
+			End:   time.Duration(w.End),
+		}
+		for _, d := range w.Weekdays {
+			window.Weekdays = append(window.Weekdays, time.Weekday(d))
+		}
+		limit.Windows = append(limit.Windows, window)
+	}
+	if limit.BytesPerSecond != 0 {
+		opts = append(opts, oppositus.WithRateLimit(limit))
+	}
+	if conf.HTTP.IdleTimeout != 0 {
+		opts = append(opts, oppositus.WithIdleTimeout(time.Duration(conf.HTTP.IdleTimeout)*time.Second))
+	}
+	if conf.FileTimeout != 0 {
+		opts = append(opts, oppositus.WithFileTimeout(time.Duration(conf.FileTimeout)*time.Second))
+	}
+	if conf.RunTimeout != 0 {
+		opts = append(opts, oppositus.WithRunTimeout(time.Duration(conf.RunTimeout)*time.Second))
+	}
+	if conf.LockWait != 0 {
+		opts = append(opts, oppositus.WithLockWait(time.Duration(conf.LockWait)*time.Second))
+	}
+	if conf.Retry.Attempts != 0 {
+		opts = append(opts, oppositus.WithRetry(oppositus.RetryPolicy{
+			Attempts:   conf.Retry.Attempts,
+			Backoff:    seconds(conf.Retry.Backoff),
+			MaxBackoff: seconds(conf.Retry.MaxBackoff),
+			Jitter:     conf.Retry.Jitter,
+			Statuses:   conf.Retry.Statuses,
+		}))
+	}
+	return opts, nil
+}
+
+// newVerifier trusts the keys in the config file, besides the
+// CoreOS Image Signing Key.
+func newVerifier(trust config.Trust) (*sig.Verifier, error) {
+	keyring := sig.DefaultKeyring()
+	for _, p := range trust.Keyrings {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := sig.ReadKeyring(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("keyring %v: %v", p, err)
+		}
+		keyring = append(keyring, keys...)
+	}
+	var policies []sig.KeyPolicy
+	for _, k := range trust.Keys {
+		policies = append(policies, sig.KeyPolicy{
+			Fingerprint: k.Fingerprint,
+			NotBefore:   time.Time(k.NotBefore),
+			NotAfter:    time.Time(k.NotAfter),
+		})
+	}
+	return sig.NewVerifier(keyring, policies...)
+}
+
+// newStorage makes the storage described by the config file, or nil
+// for the destination directory. Files for an object store are staged
+// under dest.
+func newStorage(conf *config.Config, dest string) (oppositus.Storage, error) {
+	if conf.Storage.Type != "s3" {
+		return nil, nil
+	}
+	client, err := newClient(conf)
+	if err != nil {
+		return nil, err
+	}
+	s := &s3.Storage{
+		Endpoint: conf.Storage.Endpoint,
+		Bucket:   conf.Storage.Bucket,
+		Prefix:   conf.Storage.Prefix,
+		Region:   conf.Storage.Region,
+		WorkDir:  filepath.Join(dest, ".s3-staging"),
+		Client:   client,
+	}
+	if s.AccessKeyID, err = conf.Storage.AccessKeyID.Read(); err != nil {
+		return nil, fmt.Errorf("s3 access key ID: %v", err)
+	}
+	if s.SecretAccessKey, err = conf.Storage.SecretAccessKey.Read(); err != nil {
+		return nil, fmt.Errorf("s3 secret access key: %v", err)
+	}
+	if !conf.Storage.AccessKeyID.IsSet() {
+		s.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		s.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		s.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	return s, nil
+}
+
+// needFileStorage fails if the mirror is not in the destination
+// directory, for commands that only work on that.
+func needFileStorage(conf *config.Config, cmd string) error {
+	if conf.Storage.Type == "s3" {
+		return fmt.Errorf("%s: only works with file storage", cmd)
+	}
+	return nil
+}
+
+func doit(configPath string, dest string) error {
+	ctx, stop := interruptible()
+	defer stop()
 
 	conf, err := config.Load(configPath)
 	if err != nil {
@@ -43,14 +313,43 @@ func doit(configPath string, dest string) error {
 		success = false
 		return nil
 	}
-	opts := []oppositus.Option{
-		oppositus.WithFilter(conf.Filters.Match),
-		oppositus.WithErrorHandler(errFn),
+	opts, err := options(conf)
+	if err != nil {
+		return err
 	}
-	if conf.Channels != nil {
-		opts = append(opts, oppositus.WithChannels(conf.Channels...))
+	opts = append(opts, oppositus.WithErrorHandler(errFn))
+	storage, err := newStorage(conf, dest)
+	if err != nil {
+		return err
 	}
-	if err := oppositus.Mirror(ctx, dest, opts...); err != nil {
+	if storage != nil {
+		opts = append(opts, oppositus.WithStorage(storage))
+	}
+	if dryRun {
+		opts = append(opts, oppositus.WithDryRun(true))
+	}
+	// the plan keeps the destination locked until it is executed
+	plan, err := oppositus.Prepare(ctx, dest, opts...)
+	if err != nil {
+		return err
+	}
+	defer plan.Close()
+	if dryRun {
+		printPlan(os.Stdout, plan)
+		return nil
+	}
+	rep, err := plan.Execute(ctx)
+	if rep != nil {
+		switch *report {
+		case "text":
+			printReport(os.Stdout, rep)
+		case "json":
+			if err := json.NewEncoder(os.Stdout).Encode(rep); err != nil {
+				return err
+			}
+		}
+	}
+	if err != nil {
 		return err
 	}
 	if !success {
@@ -59,16 +358,209 @@ func doit(configPath string, dest string) error {
 	return nil
 }
 
+func printPlan(w io.Writer, plan *oppositus.Plan) {
+	for _, c := range plan.Channels {
+		fmt.Fprintf(w, "%s/%s: %s\n", c.Board, c.Channel, c.Version.Version)
+	}
+	for _, v := range plan.Versions {
+		for _, f := range v.Files {
+			if f.Present {
+				continue
+			}
+			size := "?"
+			if f.Size >= 0 {
+				size = strconv.FormatInt(f.Size, 10)
+			}
+			fmt.Fprintf(w, "%s/all/%s/%s\t%s\n", v.Board, v.Version, f.Name, size)
+		}
+	}
+	fmt.Fprintf(w, "total %d bytes to fetch\n", plan.Bytes())
+}
+
+func printReport(w io.Writer, rep *oppositus.Report) {
+	for _, c := range rep.Channels {
+		switch {
+		case c.Status == oppositus.ChannelFailed && c.Previous == "":
+			fmt.Fprintf(w, "%s/%s: not mirrored (failed to mirror %s)\n", c.Board, c.Channel, c.Version)
+		case c.Status == oppositus.ChannelFailed:
+			fmt.Fprintf(w, "%s/%s: %s (failed to move to %s)\n", c.Board, c.Channel, c.Previous, c.Version)
+		case c.Status == oppositus.ChannelUnchanged:
+			fmt.Fprintf(w, "%s/%s: %s (unchanged)\n", c.Board, c.Channel, c.Version)
+		case c.Previous == "":
+			fmt.Fprintf(w, "%s/%s: %s (new)\n", c.Board, c.Channel, c.Version)
+		default:
+			fmt.Fprintf(w, "%s/%s: %s (was %s)\n", c.Board, c.Channel, c.Version, c.Previous)
+		}
+	}
+	for _, v := range rep.Versions {
+		fmt.Fprintf(w, "%s/all/%s: %d downloaded, %d skipped, %d failed, %d bytes in %v\n",
+			v.Board, v.Version, len(v.Downloaded), len(v.Skipped), len(v.Failed), v.Bytes, v.Duration.Round(time.Millisecond))
+		for _, f := range v.Failed {
+			fmt.Fprintf(w, "\t%s: %v\n", f.Name, f.Err)
+		}
+	}
+	fmt.Fprintf(w, "total %v\n", rep.Duration.Round(time.Millisecond))
+}
+
+func gc(configPath string, dest string, dryRun bool) error {
+	ctx, stop := interruptible()
+	defer stop()
+
+	conf, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+	if err := needFileStorage(conf, "gc"); err != nil {
+		return err
+	}
+	success := true
+	errFn := func(err error) error {
+		log.Printf("%v", err)
+		success = false
+		return nil
+	}
+	retention := oppositus.Retention{
+		KeepLast:   conf.GC.KeepLast,
+		KeepWithin: time.Duration(conf.GC.KeepDays) * 24 * time.Hour,
+		// don't remove what the next mirror run would fetch again
+		Pinned: append(append([]string(nil), conf.GC.Pinned...), conf.Versions...),
+	}
+	if conf.Backfill > retention.KeepLast {
+		retention.KeepLast = conf.Backfill
+	}
+	opts, err := options(conf)
+	if err != nil {
+		return err
+	}
+	opts = append(opts,
+		oppositus.WithErrorHandler(errFn),
+		oppositus.WithRetention(retention),
+		oppositus.WithDryRun(dryRun),
+	)
+	removed, err := oppositus.GC(ctx, dest, opts...)
+	for _, p := range removed {
+		if dryRun {
+			fmt.Println(p)
+			continue
+		}
+		log.Printf("removed %v", p)
+	}
+	if err != nil {
+		return err
+	}
+	if !success {
+		return errors.New("gc failed")
+	}
+	return nil
+}
+
+func verify(configPath string, dest string, jsonOut bool) error {
+	ctx, stop := interruptible()
+	defer stop()
+
+	conf, err := config.Load(configPath)
+	if err != nil {
+		return err
+	}
+	if err := needFileStorage(conf, "verify"); err != nil {
+		return err
+	}
+	success := true
+	errFn := func(err error) error {
+		log.Printf("%v", err)
+		success = false
+		return nil
+	}
+	opts, err := options(conf)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, oppositus.WithErrorHandler(errFn))
+	rep, err := oppositus.Verify(ctx, dest, opts...)
+	if rep != nil {
+		if jsonOut {
+			if err := json.NewEncoder(os.Stdout).Encode(rep); err != nil {
+				return err
+			}
+		} else {
+			for _, p := range rep.Problems {
+				fmt.Println(p)
+			}
+			fmt.Printf("%d files checked, %d problems\n", rep.Files, len(rep.Problems))
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if !success {
+		return errors.New("verify failed")
+	}
+	if len(rep.Problems) > 0 {
+		return errors.New("mirror has problems")
+	}
+	return nil
+}
+
 var prog = filepath.Base(os.Args[0])
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", prog)
 	fmt.Fprintf(os.Stderr, "  %s [OPTS] CONFIG DEST\n", prog)
+	fmt.Fprintf(os.Stderr, "  %s [OPTS] gc [-n] CONFIG DEST\n", prog)
+	fmt.Fprintf(os.Stderr, "  %s [OPTS] verify [-json] CONFIG DEST\n", prog)
 	fmt.Fprintf(os.Stderr, "\n")
 	fmt.Fprintf(os.Stderr, "Options:\n")
 	flag.PrintDefaults()
 }
 
+func gcMain(args []string) {
+	flags := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := flags.Bool("n", false, "only list what would be removed")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s gc:\n", prog)
+		fmt.Fprintf(os.Stderr, "  %s [OPTS] gc [-n] CONFIG DEST\n", prog)
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flags.PrintDefaults()
+	}
+	// error handling is ExitOnError
+	_ = flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	configPath := flags.Arg(0)
+	dest := flags.Arg(1)
+
+	if err := gc(configPath, dest, *dryRun); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func verifyMain(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	jsonOut := flags.Bool("json", false, "print the report as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s verify:\n", prog)
+		fmt.Fprintf(os.Stderr, "  %s [OPTS] verify [-json] CONFIG DEST\n", prog)
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flags.PrintDefaults()
+	}
+	// error handling is ExitOnError
+	_ = flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	configPath := flags.Arg(0)
+	dest := flags.Arg(1)
+
+	if err := verify(configPath, dest, *jsonOut); err != nil {
+		log.Fatal(err)
+	}
+}
+
 func main() {
 	log.SetFlags(0)
 
@@ -79,10 +571,24 @@ func main() {
 		fmt.Printf("%s %s\n", prog, version.Version)
 		os.Exit(0)
 	}
+	if flag.NArg() > 0 && flag.Arg(0) == "gc" {
+		gcMain(flag.Args()[1:])
+		return
+	}
+	if flag.NArg() > 0 && flag.Arg(0) == "verify" {
+		verifyMain(flag.Args()[1:])
+		return
+	}
 	if flag.NArg() != 2 {
 		flag.Usage()
 		os.Exit(2)
 	}
+	switch *report {
+	case "", "text", "json":
+	default:
+		fmt.Fprintf(os.Stderr, "%s: unknown report format: %q\n", prog, *report)
+		os.Exit(2)
+	}
 	configPath := flag.Arg(0)
 	dest := flag.Arg(1)
 
@@ -0,0 +1,207 @@
+package oppositus
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"eagain.net/go/oppositus/digests"
+	"eagain.net/go/oppositus/sig"
+	"golang.org/x/net/context"
+)
+
+// digestsSuffix marks the files that list hashes of other files.
+const digestsSuffix = ".DIGESTS"
+
+// DigestError means a file had a good signature, but did not match
+// the DIGESTS file covering it, and was discarded.
+type DigestError struct {
+	Board   string
+	Version string
+	Name    string
+	// Digests is the name of the DIGESTS file.
+	Digests string
+	// Err is a *digests.MismatchError, or an error from reading
+	// the files.
+	Err error
+}
+
+func (e *DigestError) Error() string {
+	return fmt.Sprintf("bad digest: %v/%v/%v: %v", e.Board, e.Version, e.Name, e.Err)
+}
+
+// WithDigestedFiles mirrors files that have no signature, if a
+// signed DIGESTS file in the same directory lists their hashes. Such
+// files are only stored if they match. By default, only signed files
+// are mirrored.
+func WithDigestedFiles(enable bool) Option {
+	return func(conf *config) error {
+		conf.digested = enable
+		return nil
+	}
+}
+
+// checkDigests confirms that the files of the version match the
+// DIGESTS files covering them. The DIGESTS files are signed, so their
+// signatures were checked when downloaded. Only files downloaded now,
+// or covered by a DIGESTS file downloaded now, are checked; the rest
+// were checked in earlier runs.
+func (m *mirrorer) checkDigests(ctx context.Context, v *VersionPlan, downloaded map[string]bool) error {
+	for _, f := range v.Files {
+		if f.Unsigned || !strings.HasSuffix(f.Name, digestsSuffix) {
+			continue
+		}
+		if !f.Present && !downloaded[f.Name] {
+			// failed to download
+			continue
+		}
+		d, err := m.readDigests(ctx, v, f.Name)
+		if err != nil {
+			if err := m.errs.handle(err); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, name := range d.Names() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !downloaded[name] && !downloaded[f.Name] {
+				continue
+			}
+			if err := m.checkDigest(ctx, v, d, f.Name, name); err != nil {
+				if err := m.errs.handle(err); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkDigest checks one file against a DIGESTS file. It runs before
+// the version is committed, and a file that does not match is removed
+// from the staging directory, along with its signature, so it is
+// never published. Files committed in earlier runs are only reported.
+func (m *mirrorer) checkDigest(ctx context.Context, v *VersionPlan, d digests.Digests, digestsName, name string) error {
+	p := filepath.Join(v.local, name)
+	f, err := m.open(ctx, v, name)
+	if os.IsNotExist(err) {
+		// not mirrored
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = d.Verify(name, f)
+	f.Close()
+	if err == nil {
+		m.obs.observe(&DigestVerified{Board: v.Board, Version: v.Version, Name: name, Digests: digestsName})
+		return nil
+	}
+	derr := &DigestError{Board: v.Board, Version: v.Version, Name: name, Digests: digestsName, Err: err}
+	if _, ok := err.(*digests.MismatchError); ok {
+		for _, rm := range []string{p, p + ".sig"} {
+			if err := os.Remove(rm); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	m.obs.observe(&DigestFailed{Board: v.Board, Version: v.Version, Name: name, Digests: digestsName, Err: derr})
+	return derr
+}
+
+// readDigests reads a DIGESTS file of the version.
+func (m *mirrorer) readDigests(ctx context.Context, v *VersionPlan, name string) (digests.Digests, error) {
+	f, err := m.open(ctx, v, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d, err := digests.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path.Join(v.dir(), name), err)
+	}
+	return d, nil
+}
+
+// verifiedDigests reads the DIGESTS files of the version that have
+// been mirrored, and so have good signatures.
+func (m *mirrorer) verifiedDigests(ctx context.Context, v *VersionPlan, downloaded map[string]bool) (names []string, ds []digests.Digests) {
+	for _, f := range v.Files {
+		if f.Unsigned || !strings.HasSuffix(f.Name, digestsSuffix) {
+			continue
+		}
+		if !f.Present && !downloaded[f.Name] {
+			continue
+		}
+		d, err := m.readDigests(ctx, v, f.Name)
+		if err != nil {
+			// already passed to the error handler by checkDigests
+			continue
+		}
+		names = append(names, f.Name)
+		ds = append(ds, d)
+	}
+	return names, ds
+}
+
+// mirrorUnsigned downloads the unsigned files of the version that are
+// covered by signed DIGESTS files.
+func (m *mirrorer) mirrorUnsigned(ctx context.Context, v *VersionPlan, downloaded map[string]bool) error {
+	names, ds := m.verifiedDigests(ctx, v, downloaded)
+	var wg sync.WaitGroup
+	for _, f := range v.Files {
+		if f.Present || !f.Unsigned {
+			continue
+		}
+		idx := -1
+		for i, d := range ds {
+			if _, ok := d[f.Name]; ok {
+				idx = i
+				break
+			}
+		}
+		if idx == -1 {
+			m.obs.observe(&FileSkipped{Board: v.Board, Version: v.Version, Name: f.Name, Reason: SkipUnverified})
+			continue
+		}
+		wg.Add(1)
+		go func(f FilePlan, digestsName string, d digests.Digests) {
+			defer wg.Done()
+			if err := m.mirrorDigested(ctx, v, f, digestsName, d); err != nil {
+				_ = m.errs.handle(err)
+			}
+		}(f, names[idx], ds[idx])
+	}
+	wg.Wait()
+	return m.errs.err()
+}
+
+// mirrorDigested downloads an unsigned file, and keeps it only if it
+// matches the DIGESTS file.
+func (m *mirrorer) mirrorDigested(ctx context.Context, v *VersionPlan, f FilePlan, digestsName string, d digests.Digests) error {
+	verify := func(r io.Reader) error {
+		if err := d.Verify(f.Name, r); err != nil {
+			return &DigestError{Board: v.Board, Version: v.Version, Name: f.Name, Digests: digestsName, Err: err}
+		}
+		return nil
+	}
+	err := m.download(ctx, v, f, func(ctx context.Context, d *sig.Downloader) error {
+		return d.DownloadVerified(ctx, v.local, f.URL, verify)
+	})
+	if err != nil {
+		if _, ok := err.(*DigestError); ok {
+			m.obs.observe(&DigestFailed{Board: v.Board, Version: v.Version, Name: f.Name, Digests: digestsName, Err: err})
+		} else {
+			m.obs.observe(&DownloadFailed{Board: v.Board, Version: v.Version, Name: f.Name, Err: err})
+		}
+		return err
+	}
+	m.obs.observe(&DigestVerified{Board: v.Board, Version: v.Version, Name: f.Name, Digests: digestsName})
+	return nil
+}
@@ -0,0 +1,159 @@
+package oppositus_test
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"eagain.net/go/oppositus"
+	"eagain.net/go/oppositus/channels"
+	"golang.org/x/net/context"
+)
+
+func TestMirrorDigests(t *testing.T) {
+	good := sha512.Sum512(readTestdata(t, "version.txt"))
+	bad := sha512.Sum512([]byte("evil\n"))
+	tests := []struct {
+		sum [sha512.Size]byte
+		ok  bool
+	}{
+		{sum: good, ok: true},
+		{sum: bad, ok: false},
+	}
+	for i, test := range tests {
+		files := upstreamFiles(t)
+		digestsContent := []byte(fmt.Sprintf("# SHA512 HASH\n%x  version.txt\n", test.sum))
+		files["stable/"+testVersion+"/version.txt.DIGESTS"] = digestsContent
+		files["stable/"+testVersion+"/version.txt.DIGESTS.sig"] = []byte("unused")
+		srv := newUpstream(t, files)
+		dst := tempDir(t)
+
+		// pretend the DIGESTS file was mirrored in an earlier run,
+		// as we cannot sign one here
+		verPath := filepath.Join(dst, "amd64-usr", "all", testVersion)
+		if err := os.MkdirAll(verPath, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(verPath, "version.txt.DIGESTS"), digestsContent, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var errs []error
+		var verified []string
+		_, err := oppositus.Mirror(context.Background(), dst,
+			oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+			oppositus.WithChannels(channels.Stable),
+			oppositus.WithErrorHandler(func(err error) error {
+				errs = append(errs, err)
+				return nil
+			}),
+			oppositus.WithObserver(func(ev oppositus.Event) {
+				switch ev := ev.(type) {
+				case *oppositus.SignatureVerified:
+					// the digest has not been checked yet
+					if _, err := os.Stat(filepath.Join(verPath, ev.Name)); !os.IsNotExist(err) {
+						t.Errorf("#%d: published before checking the digest: %v", i, err)
+					}
+				case *oppositus.DigestVerified:
+					verified = append(verified, ev.Name)
+				}
+			}),
+		)
+		if err != nil {
+			t.Fatalf("#%d: mirror: %v", i, err)
+		}
+		_, statErr := os.Stat(filepath.Join(verPath, "version.txt"))
+		if test.ok {
+			if len(errs) != 0 {
+				t.Errorf("#%d: unexpected errors: %v", i, errs)
+			}
+			if g, e := fmt.Sprint(verified), "[version.txt]"; g != e {
+				t.Errorf("#%d: wrong files verified: %v != %v", i, g, e)
+			}
+			if statErr != nil {
+				t.Errorf("#%d: not mirrored: %v", i, statErr)
+			}
+		} else {
+			err := assertNotPublished(t, dst, "amd64-usr", testVersion, errs)
+			if _, ok := err.(*oppositus.DigestError); !ok {
+				t.Errorf("#%d: wrong error: %v", i, err)
+			}
+			if !os.IsNotExist(statErr) {
+				t.Errorf("#%d: file with bad digest was kept: %v", i, statErr)
+			}
+		}
+		srv.Close()
+		os.RemoveAll(dst)
+	}
+}
+
+func TestMirrorDigestedFiles(t *testing.T) {
+	extra := []byte("not signed\n")
+	sum := sha512.Sum512(extra)
+	tests := []struct {
+		enable  bool
+		content []byte
+		want    bool
+	}{
+		{enable: false, content: extra, want: false},
+		{enable: true, content: extra, want: true},
+		{enable: true, content: []byte("evil\n"), want: false},
+	}
+	for i, test := range tests {
+		files := upstreamFiles(t)
+		digestsContent := []byte(fmt.Sprintf("# SHA512 HASH\n%x  extra.txt\n", sum))
+		files["stable/"+testVersion+"/extra.DIGESTS"] = digestsContent
+		files["stable/"+testVersion+"/extra.DIGESTS.sig"] = []byte("unused")
+		files["stable/"+testVersion+"/extra.txt"] = test.content
+		files["stable/"+testVersion+"/uncovered.txt"] = []byte("not signed either\n")
+		srv := newUpstream(t, files)
+		dst := tempDir(t)
+
+		// pretend the DIGESTS file was mirrored in an earlier run,
+		// as we cannot sign one here
+		verPath := filepath.Join(dst, "amd64-usr", "all", testVersion)
+		if err := os.MkdirAll(verPath, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(verPath, "extra.DIGESTS"), digestsContent, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var errs []error
+		rep, err := oppositus.Mirror(context.Background(), dst,
+			oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+			oppositus.WithChannels(channels.Stable),
+			oppositus.WithDigestedFiles(test.enable),
+			oppositus.WithErrorHandler(func(err error) error {
+				errs = append(errs, err)
+				return nil
+			}),
+		)
+		if err != nil {
+			t.Fatalf("#%d: mirror: %v", i, err)
+		}
+		_, statErr := os.Stat(filepath.Join(verPath, "extra.txt"))
+		if got := statErr == nil; got != test.want {
+			t.Errorf("#%d: wrong outcome: mirrored=%v: %v", i, got, errs)
+		}
+		if _, err := os.Stat(filepath.Join(verPath, "uncovered.txt")); !os.IsNotExist(err) {
+			t.Errorf("#%d: uncovered file was mirrored: %v", i, err)
+		}
+		if test.want {
+			if g, e := fmt.Sprint(rep.Channels[0].Downloaded), "[version.txt extra.txt]"; g != e {
+				t.Errorf("#%d: wrong downloads: %v != %v", i, g, e)
+			}
+		}
+		if test.enable && !test.want {
+			err := assertNotPublished(t, dst, "amd64-usr", testVersion, errs)
+			if _, ok := err.(*oppositus.DigestError); !ok {
+				t.Errorf("#%d: wrong error: %v", i, err)
+			}
+		}
+		srv.Close()
+		os.RemoveAll(dst)
+	}
+}
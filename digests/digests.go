@@ -0,0 +1,152 @@
+// Package digests parses the *.DIGESTS files published next to
+// CoreOS release images, and checks files against them.
+//
+// A DIGESTS file has sections for hash algorithms, each listing files
+// in the format of md5sum(1):
+//
+//	# MD5 HASH
+//	4c5e3d2b...  coreos_production_image.bin.bz2
+//	# SHA1 HASH
+//	1b6453892473a467d07372d45eb05abc2031647a  coreos_production_image.bin.bz2
+//
+// The DIGESTS file must itself be verified, for example with
+// sig.Check, before it can be trusted.
+package digests
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Algorithms maps the names used in section headers to hash
+// functions.
+var Algorithms = map[string]func() hash.Hash{
+	"MD5":    md5.New,
+	"SHA1":   sha1.New,
+	"SHA256": sha256.New,
+	"SHA512": sha512.New,
+}
+
+// Digests are the hashes of files, by file name and algorithm.
+type Digests map[string]map[string][]byte
+
+// ErrNotListed means a file is not listed in the DIGESTS file.
+var ErrNotListed = errors.New("file not listed in digests")
+
+// MismatchError means a file does not have the hash listed in the
+// DIGESTS file.
+type MismatchError struct {
+	Name      string
+	Algorithm string
+	Want      []byte
+	Got       []byte
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("%s mismatch for %s: %x != %x", e.Algorithm, e.Name, e.Got, e.Want)
+}
+
+// Parse reads a DIGESTS file. Sections for unknown algorithms are
+// ignored.
+func Parse(r io.Reader) (Digests, error) {
+	d := make(Digests)
+	scanner := bufio.NewScanner(r)
+	var algo string
+	known := false
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(strings.TrimPrefix(line, "#"))
+			if len(fields) != 2 || fields[1] != "HASH" {
+				return nil, fmt.Errorf("digests: line %d: bad section header: %q", lineNum, line)
+			}
+			algo = fields[0]
+			_, known = Algorithms[algo]
+			continue
+		}
+		if algo == "" {
+			return nil, fmt.Errorf("digests: line %d: hash outside of section", lineNum)
+		}
+		if !known {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("digests: line %d: bad hash line: %q", lineNum, line)
+		}
+		sum, err := hex.DecodeString(fields[0])
+		if err != nil || len(sum) != Algorithms[algo]().Size() {
+			return nil, fmt.Errorf("digests: line %d: bad %s hash: %q", lineNum, algo, fields[0])
+		}
+		// md5sum marks binary mode with a star
+		name := strings.TrimPrefix(fields[1], "*")
+		if strings.ContainsAny(name, `/\`) {
+			return nil, fmt.Errorf("digests: line %d: file name must not contain a path: %q", lineNum, name)
+		}
+		if d[name] == nil {
+			d[name] = make(map[string][]byte)
+		}
+		d[name][algo] = sum
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Names returns the files listed, sorted.
+func (d Digests) Names() []string {
+	names := make([]string, 0, len(d))
+	for name := range d {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Verify reads the content of the named file from r, and checks it
+// against every hash listed for it. The error is ErrNotListed or a
+// *MismatchError if the content cannot be vouched for.
+func (d Digests) Verify(name string, r io.Reader) error {
+	want, ok := d[name]
+	if !ok {
+		return ErrNotListed
+	}
+	algos := make([]string, 0, len(want))
+	for algo := range want {
+		algos = append(algos, algo)
+	}
+	// report the strongest mismatch
+	sort.Sort(sort.Reverse(sort.StringSlice(algos)))
+	hashes := make([]hash.Hash, len(algos))
+	writers := make([]io.Writer, len(algos))
+	for i, algo := range algos {
+		hashes[i] = Algorithms[algo]()
+		writers[i] = hashes[i]
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), r); err != nil {
+		return err
+	}
+	for i, algo := range algos {
+		if got := hashes[i].Sum(nil); !bytes.Equal(got, want[algo]) {
+			return &MismatchError{Name: name, Algorithm: algo, Want: want[algo], Got: got}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package digests_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"eagain.net/go/oppositus/digests"
+)
+
+const helloDigests = `# MD5 HASH
+b1946ac92492d2347c6235b4d2611184  hello.txt
+# SHA1 HASH
+f572d396fae9206628714fb2ce00f72e94f2258f  hello.txt
+# SHA512 HASH
+e7c22b994c59d9cf2b48e549b1e24666636045930d3da7c1acb299d1c3b7f931f94aae41edda2c2b207a36e10f8bcb8d45223e54878f5b316e7ce3b6bc019629  hello.txt
+# WHIRLPOOL HASH
+0123  hello.txt
+`
+
+func TestParse(t *testing.T) {
+	d, err := digests.Parse(strings.NewReader(helloDigests))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if g, e := d.Names(), []string{"hello.txt"}; !reflect.DeepEqual(g, e) {
+		t.Errorf("wrong names: %q != %q", g, e)
+	}
+	if g, e := len(d["hello.txt"]), 3; g != e {
+		t.Errorf("wrong number of hashes: %d != %d", g, e)
+	}
+}
+
+func TestParseBad(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{"b1946ac92492d2347c6235b4d2611184  hello.txt\n", "digests: line 1: hash outside of section"},
+		{"# MD5\n", `digests: line 1: bad section header: "# MD5"`},
+		{"# MD5 HASH\nb1946ac9  hello.txt\n", `digests: line 2: bad MD5 hash: "b1946ac9"`},
+		{"# MD5 HASH\nb1946ac92492d2347c6235b4d2611184\n", `digests: line 2: bad hash line: "b1946ac92492d2347c6235b4d2611184"`},
+		{"# MD5 HASH\nb1946ac92492d2347c6235b4d2611184  ../hello.txt\n", `digests: line 2: file name must not contain a path: "../hello.txt"`},
+	}
+	for i, test := range tests {
+		_, err := digests.Parse(strings.NewReader(test.input))
+		if err == nil {
+			t.Errorf("#%d: expected an error", i)
+			continue
+		}
+		if g, e := err.Error(), test.err; g != e {
+			t.Errorf("#%d: wrong error: %q != %q", i, g, e)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	d, err := digests.Parse(strings.NewReader(helloDigests))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if err := d.Verify("hello.txt", strings.NewReader("hello\n")); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+	err = d.Verify("hello.txt", strings.NewReader("goodbye\n"))
+	merr, ok := err.(*digests.MismatchError)
+	if !ok {
+		t.Fatalf("expected a mismatch: %v", err)
+	}
+	if g, e := merr.Algorithm, "SHA512"; g != e {
+		t.Errorf("wrong algorithm: %q != %q", g, e)
+	}
+	if err := d.Verify("other.txt", strings.NewReader("hello\n")); err != digests.ErrNotListed {
+		t.Errorf("wrong error for unlisted file: %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package oppositus
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"eagain.net/go/oppositus/channels"
+)
+
+// Event is something that happened while mirroring. It is one of the
+// event types in this package, such as *ChannelResolved.
+type Event interface {
+	event()
+}
+
+// ChannelResolved means the version a channel is at is now known.
+type ChannelResolved struct {
+	Board   string
+	Channel channels.Channel
+	Version string
+}
+
+// VersionStarted means the missing files of a version are about to
+// be downloaded.
+type VersionStarted struct {
+	Board   string
+	Version string
+	URL     *url.URL
+}
+
+// VersionPublished means a version was complete, and was committed to
+// the storage for the first time.
+type VersionPublished struct {
+	Board   string
+	Version string
+}
+
+// VersionCompleted means all files of a version have been processed.
+// Err is set if mirroring the version failed as a whole; failures of
+// single files are reported with DownloadFailed and SignatureFailed.
+type VersionCompleted struct {
+	Board   string
+	Version string
+	Err     error
+}
+
+// SkipReason tells why a file was not downloaded.
+type SkipReason int
+
+// Reasons for skipping a file.
+const (
+	// SkipFiltered means the file did not pass the filter.
+	SkipFiltered SkipReason = iota + 1
+	// SkipPresent means the file has already been mirrored.
+	SkipPresent
+	// SkipUnverified means the file has no signature, and no signed
+	// DIGESTS file covers it.
+	SkipUnverified
+)
+
+func (r SkipReason) String() string {
+	switch r {
+	case SkipFiltered:
+		return "filtered"
+	case SkipPresent:
+		return "present"
+	case SkipUnverified:
+		return "unverified"
+	}
+	return fmt.Sprintf("SkipReason(%d)", int(r))
+}
+
+// FileSkipped means a file of a version will not be downloaded.
+type FileSkipped struct {
+	Board   string
+	Version string
+	Name    string
+	Reason  SkipReason
+}
+
+// DownloadStarted means a file is about to be downloaded.
+type DownloadStarted struct {
+	Board   string
+	Version string
+	Name    string
+}
+
+// DownloadProgress tells how much of a file has been downloaded.
+type DownloadProgress struct {
+	Board   string
+	Version string
+	Name    string
+	Bytes   int64
+	// Total is the size of the file, or -1 if unknown.
+	Total int64
+	// Transferred is how many of Bytes were fetched by this run.
+	// The rest was resumed from a download interrupted earlier.
+	Transferred int64
+}
+
+// DownloadFailed means a file could not be downloaded, for some
+// other reason than a bad signature.
+type DownloadFailed struct {
+	Board   string
+	Version string
+	Name    string
+	Err     error
+}
+
+// SignatureVerified means a file has been downloaded and its
+// signature checked. It is only staged, and is published when its
+// version is committed, which may not happen if other checks fail.
+type SignatureVerified struct {
+	Board   string
+	Version string
+	Name    string
+}
+
+// SignatureFailed means a downloaded file had a bad signature, and
+// was discarded, or moved to the quarantine set with WithQuarantine.
+type SignatureFailed struct {
+	Board   string
+	Version string
+	Name    string
+	Err     error
+}
+
+// DigestVerified means a file matched the DIGESTS file covering it.
+type DigestVerified struct {
+	Board   string
+	Version string
+	Name    string
+	Digests string
+}
+
+// DigestFailed means a file did not match the DIGESTS file covering
+// it, and was discarded.
+type DigestFailed struct {
+	Board   string
+	Version string
+	Name    string
+	Digests string
+	Err     error
+}
+
+// SymlinkUpdated means a symlink in a channel directory was set to
+// point to Target.
+type SymlinkUpdated struct {
+	Board   string
+	Channel channels.Channel
+	Name    string
+	Target  string
+}
+
+// Retrying means a request failed, and will be tried again after
+// Delay. Attempt counts the failed attempts so far.
+type Retrying struct {
+	URL     *url.URL
+	Attempt int
+	Delay   time.Duration
+	Err     error
+}
+
+func (*ChannelResolved) event()   {}
+func (*VersionStarted) event()    {}
+func (*VersionPublished) event()  {}
+func (*VersionCompleted) event()  {}
+func (*FileSkipped) event()       {}
+func (*DownloadStarted) event()   {}
+func (*DownloadProgress) event()  {}
+func (*DownloadFailed) event()    {}
+func (*SignatureVerified) event() {}
+func (*SignatureFailed) event()   {}
+func (*DigestVerified) event()    {}
+func (*DigestFailed) event()      {}
+func (*SymlinkUpdated) event()    {}
+func (*Retrying) event()          {}
+
+// WithObserver sets a function that is told about progress. The
+// function is never called concurrently, and must not block for
+// long. By default, progress is logged with the log package.
+func WithObserver(fn func(Event)) Option {
+	return func(conf *config) error {
+		conf.observer = fn
+		return nil
+	}
+}
+
+// logEvent is the default observer. It logs the major events.
+func logEvent(ev Event) {
+	switch ev := ev.(type) {
+	case *ChannelResolved:
+		log.Printf("channel %v/%v is at version %v", ev.Board, ev.Channel, ev.Version)
+	case *VersionStarted:
+		log.Printf("mirroring %v", ev.URL)
+	case *VersionPublished:
+		log.Printf("published %v/%v", ev.Board, ev.Version)
+	case *DownloadStarted:
+		log.Printf("downloading %v", ev.Name)
+	case *Retrying:
+		log.Printf("retrying in %v: %v", ev.Delay, ev.Err)
+	}
+}
+
+// observer serializes calls to the function set with WithObserver.
+type observer struct {
+	mu sync.Mutex
+	fn func(Event)
+}
+
+func (o *observer) observe(ev Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.fn(ev)
+}
@@ -0,0 +1,156 @@
+package oppositus_test
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"eagain.net/go/oppositus"
+	"eagain.net/go/oppositus/channels"
+	"golang.org/x/net/context"
+)
+
+// describe summarizes events, leaving out progress reports that
+// depend on timing.
+func describe(events []oppositus.Event) []string {
+	var got []string
+	for _, ev := range events {
+		switch ev := ev.(type) {
+		case *oppositus.ChannelResolved:
+			got = append(got, fmt.Sprintf("resolved %v/%v %v", ev.Board, ev.Channel, ev.Version))
+		case *oppositus.VersionStarted:
+			got = append(got, fmt.Sprintf("started %v", ev.Version))
+		case *oppositus.VersionPublished:
+			got = append(got, fmt.Sprintf("published %v", ev.Version))
+		case *oppositus.VersionCompleted:
+			got = append(got, fmt.Sprintf("completed %v %v", ev.Version, ev.Err))
+		case *oppositus.FileSkipped:
+			got = append(got, fmt.Sprintf("skipped %v %v", ev.Name, ev.Reason))
+		case *oppositus.DownloadStarted:
+			got = append(got, fmt.Sprintf("downloading %v", ev.Name))
+		case *oppositus.DownloadFailed:
+			got = append(got, fmt.Sprintf("failed %v", ev.Name))
+		case *oppositus.SignatureVerified:
+			got = append(got, fmt.Sprintf("verified %v", ev.Name))
+		case *oppositus.SignatureFailed:
+			got = append(got, fmt.Sprintf("bad signature %v", ev.Name))
+		case *oppositus.SymlinkUpdated:
+			got = append(got, fmt.Sprintf("symlink %v/%v/%v -> %v", ev.Board, ev.Channel, ev.Name, ev.Target))
+		}
+	}
+	return got
+}
+
+func TestObserver(t *testing.T) {
+	tests := []struct {
+		content string
+		want    []string
+	}{
+		{
+			want: []string{
+				"resolved amd64-usr/stable " + testVersion,
+				"started " + testVersion,
+				"downloading version.txt",
+				"verified version.txt",
+				"published " + testVersion,
+				"completed " + testVersion + " <nil>",
+				"symlink amd64-usr/stable/" + testVersion + " -> ../all/" + testVersion,
+				"symlink amd64-usr/stable/current -> ../all/" + testVersion,
+			},
+		},
+		{
+			content: "junk\n",
+			want: []string{
+				"resolved amd64-usr/stable " + testVersion,
+				"started " + testVersion,
+				"downloading version.txt",
+				"bad signature version.txt",
+				"completed " + testVersion + " incomplete version: amd64-usr/" + testVersion + ": missing version.txt",
+			},
+		},
+	}
+
+	for i, test := range tests {
+		files := upstreamFiles(t)
+		if test.content != "" {
+			files["stable/"+testVersion+"/version.txt"] = []byte(test.content)
+		}
+		srv := newUpstream(t, files)
+		dst := tempDir(t)
+
+		var events []oppositus.Event
+		var progress bool
+		_, err := oppositus.Mirror(context.Background(), dst,
+			oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+			oppositus.WithChannels(channels.Stable),
+			oppositus.WithErrorHandler(func(error) error { return nil }),
+			oppositus.WithObserver(func(ev oppositus.Event) {
+				if p, ok := ev.(*oppositus.DownloadProgress); ok {
+					if p.Bytes == p.Total {
+						progress = true
+					}
+				}
+				events = append(events, ev)
+			}),
+		)
+		srv.Close()
+		os.RemoveAll(dst)
+		if err != nil {
+			t.Errorf("#%d: mirror: %v", i, err)
+			continue
+		}
+		got := describe(events)
+		if g, e := strings.Join(got, "\n"), strings.Join(test.want, "\n"); g != e {
+			t.Errorf("#%d: wrong events:\n%s\nwant:\n%s", i, g, e)
+		}
+		if !progress {
+			t.Errorf("#%d: no progress reported for the whole file", i)
+		}
+	}
+}
+
+func TestObserverSkipped(t *testing.T) {
+	files := upstreamFiles(t)
+	files["stable/"+testVersion+"/other.txt"] = files["stable/"+testVersion+"/version.txt"]
+	files["stable/"+testVersion+"/other.txt.sig"] = files["stable/"+testVersion+"/version.txt.sig"]
+	srv := newUpstream(t, files)
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	for _, want := range []string{"skipped version.txt filtered", "skipped other.txt present"} {
+		var events []oppositus.Event
+		plan, err := oppositus.Prepare(context.Background(), dst,
+			oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+			oppositus.WithChannels(channels.Stable),
+			oppositus.WithFilter(func(name string) bool { return name == "other.txt" }),
+			oppositus.WithObserver(func(ev oppositus.Event) {
+				events = append(events, ev)
+			}),
+		)
+		if err != nil {
+			t.Fatalf("prepare: %v", err)
+		}
+		plan.Close()
+		found := false
+		for _, s := range describe(events) {
+			if s == want {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("missing event %q: %q", want, describe(events))
+		}
+
+		_, err = oppositus.Mirror(context.Background(), dst,
+			oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+			oppositus.WithChannels(channels.Stable),
+			oppositus.WithFilter(func(name string) bool { return name == "other.txt" }),
+			oppositus.WithObserver(func(oppositus.Event) {}),
+		)
+		if err != nil {
+			t.Fatalf("mirror: %v", err)
+		}
+	}
+}
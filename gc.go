@@ -0,0 +1,305 @@
+package oppositus
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"eagain.net/go/oppositus/internal/versionsel"
+	"eagain.net/go/oppositus/versionfile"
+	"golang.org/x/net/context"
+)
+
+// Retention decides which versions GC keeps. Versions that a channel
+// is currently or was previously at are always kept.
+type Retention struct {
+	// KeepLast keeps this many of the newest versions that every
+	// channel has been at.
+	KeepLast int
+	// KeepWithin keeps versions that a channel has been at within
+	// this duration.
+	KeepWithin time.Duration
+	// Pinned versions are never removed. They are given as
+	// selectors like "899.17.0" or ">=1010.0.0 <1100".
+	Pinned []string
+}
+
+// WithRetention sets what versions GC keeps. By default, only the
+// current and previous versions of channels are kept.
+func WithRetention(r Retention) Option {
+	return func(conf *config) error {
+		conf.retention = r
+		return nil
+	}
+}
+
+// WithDryRun makes GC only report what it would remove, without
+// removing anything. For Prepare, it means the plan is only to be
+// looked at: the sizes of missing files are asked for, a destination
+// that does not exist is not created, nor locked, nor used for
+// caching, and the plan cannot be executed.
+func WithDryRun(dryRun bool) Option {
+	return func(conf *config) error {
+		conf.dryRun = dryRun
+		return nil
+	}
+}
+
+// staleTempAge is how old temporary files left behind by crashed runs
+// must be before GC removes them. Files being downloaded are written
+// to constantly, so this is only about giving slow runs some leeway.
+const staleTempAge = 24 * time.Hour
+
+// GC removes versions that are no longer needed from the mirror at
+// dst, according to the retention policy set with WithRetention. It
+// also removes temporary files left behind by crashed runs, and
+// versions that have been left unpublished for a day.
+//
+// GC returns the paths it removed, or with WithDryRun, the paths it
+// would remove. Errors are passed to the handler set with
+// WithErrorHandler.
+func GC(ctx context.Context, dst string, opts ...Option) ([]string, error) {
+	conf, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	release, err := lockDst(ctx, conf, dst, false)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	g := &collector{
+		conf: conf,
+		now:  time.Now(),
+	}
+	for _, s := range conf.retention.Pinned {
+		sel, err := versionsel.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		g.pinned = append(g.pinned, sel)
+	}
+	for _, board := range conf.boards {
+		if err := ctx.Err(); err != nil {
+			return g.removed, err
+		}
+		if err := g.board(filepath.Join(dst, board)); err != nil {
+			if err := conf.errFn(err); err != nil {
+				return g.removed, err
+			}
+		}
+	}
+	return g.removed, nil
+}
+
+// collector holds the state of one GC call.
+type collector struct {
+	conf    *config
+	now     time.Time
+	pinned  []versionsel.Selector
+	removed []string
+}
+
+func (g *collector) isPinned(version string) bool {
+	for _, sel := range g.pinned {
+		if sel.Match(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// membership records that a channel has been at a version.
+type membership struct {
+	// link is the symlink in the channel directory.
+	link    string
+	version string
+	// pointer is true for "current" and "previous", which always
+	// keep their version.
+	pointer bool
+	// seen is when the channel was last seen at the version.
+	seen time.Time
+}
+
+// readChannel finds the versions the channel directory links to.
+func readChannel(dir string) ([]membership, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var members []membership
+	for _, fi := range fis {
+		if fi.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		link := filepath.Join(dir, fi.Name())
+		target, err := os.Readlink(link)
+		if err != nil {
+			return nil, err
+		}
+		parent, version := path.Split(target)
+		if parent != "../all/" {
+			// not ours
+			continue
+		}
+		members = append(members, membership{
+			link:    link,
+			version: version,
+			pointer: fi.Name() == currentLink || fi.Name() == previousLink,
+			seen:    fi.ModTime(),
+		})
+	}
+	return members, nil
+}
+
+// board garbage collects the board directory dir.
+func (g *collector) board(dir string) error {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	keep := make(map[string]bool)
+	var links []membership
+	var chanDirs []string
+	for _, fi := range fis {
+		if !fi.IsDir() || fi.Name() == "all" || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		chanDir := filepath.Join(dir, fi.Name())
+		chanDirs = append(chanDirs, chanDir)
+		members, err := readChannel(chanDir)
+		if err != nil {
+			return err
+		}
+		links = append(links, members...)
+		g.retain(keep, members)
+	}
+
+	allPath := filepath.Join(dir, "all")
+	versions, err := ioutil.ReadDir(allPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var verDirs []string
+	for _, fi := range versions {
+		if isStaging(fi) && g.now.Sub(fi.ModTime()) >= staleTempAge {
+			// abandoned
+			if err := g.remove(filepath.Join(allPath, fi.Name())); err != nil {
+				return err
+			}
+			continue
+		}
+		if !fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		verPath := filepath.Join(allPath, fi.Name())
+		if keep[fi.Name()] || g.isPinned(fi.Name()) {
+			verDirs = append(verDirs, verPath)
+			continue
+		}
+		// remove the links first, so a crash never leaves them
+		// dangling
+		for _, m := range links {
+			if m.version == fi.Name() {
+				if err := g.remove(m.link); err != nil {
+					return err
+				}
+			}
+		}
+		if err := g.remove(verPath); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range append(append([]string{dir}, chanDirs...), verDirs...) {
+		if err := g.sweep(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retain marks the versions in members that the retention policy
+// keeps. members must be the versions of a single channel.
+func (g *collector) retain(keep map[string]bool, members []membership) {
+	r := g.conf.retention
+	var versions []string
+	seen := make(map[string]bool)
+	for _, m := range members {
+		if m.pointer {
+			keep[m.version] = true
+		}
+		if r.KeepWithin > 0 && g.now.Sub(m.seen) <= r.KeepWithin {
+			keep[m.version] = true
+		}
+		if !seen[m.version] {
+			seen[m.version] = true
+			versions = append(versions, m.version)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versionfile.Compare(versions[i], versions[j]) > 0
+	})
+	for i := 0; i < r.KeepLast && i < len(versions); i++ {
+		keep[versions[i]] = true
+	}
+}
+
+// isTemp reports whether name looks like a temporary file made by
+// sig.Download or atomic.Symlink, or an interrupted download left
+// for resuming.
+func isTemp(name string) bool {
+	if !strings.HasPrefix(name, ".") {
+		return false
+	}
+	return strings.Contains(name, ".tmp.") || strings.HasSuffix(name, ".tmp") ||
+		strings.HasSuffix(name, ".partial") || strings.HasSuffix(name, ".partial.validator")
+}
+
+// isStaging reports whether fi is the staging directory of a version
+// that has not been published.
+func isStaging(fi os.FileInfo) bool {
+	return fi.IsDir() && strings.HasPrefix(fi.Name(), ".") && strings.HasSuffix(fi.Name(), stagingSuffix)
+}
+
+// sweep removes stale temporary files from dir.
+func (g *collector) sweep(dir string) error {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if fi.IsDir() || !isTemp(fi.Name()) {
+			continue
+		}
+		if g.now.Sub(fi.ModTime()) < staleTempAge {
+			continue
+		}
+		if err := g.remove(filepath.Join(dir, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *collector) remove(p string) error {
+	g.removed = append(g.removed, p)
+	if g.conf.dryRun {
+		return nil
+	}
+	return os.RemoveAll(p)
+}
@@ -0,0 +1,196 @@
+package oppositus_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"eagain.net/go/oppositus"
+	"golang.org/x/net/context"
+)
+
+// makeMirror creates a mirror where stable is at 4.0.0 and has been
+// at 3.0.0 and 2.0.0, and beta is at 3.0.0. Versions 5.0.0 and 6.0.0
+// are unpublished.
+func makeMirror(t testing.TB) string {
+	dst := tempDir(t)
+	board := filepath.Join(dst, "amd64-usr")
+	for _, version := range []string{"1.0.0", "2.0.0", "3.0.0", "4.0.0"} {
+		if err := os.MkdirAll(filepath.Join(board, "all", version), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := []struct {
+		channel, name, version string
+	}{
+		{"stable", "current", "4.0.0"},
+		{"stable", "3.0.0", "3.0.0"},
+		{"stable", "2.0.0", "2.0.0"},
+		{"beta", "current", "3.0.0"},
+	}
+	for _, l := range links {
+		if err := os.MkdirAll(filepath.Join(board, l.channel), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink("../all/"+l.version, filepath.Join(board, l.channel, l.name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	// versions being assembled, one of them abandoned
+	for _, name := range []string{".5.0.0.staging", ".6.0.0.staging"} {
+		p := filepath.Join(board, "all", name)
+		if err := os.Mkdir(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if name == ".5.0.0.staging" {
+			if err := os.Chtimes(p, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, name := range []string{".foo.tmp.1234", ".bar.tmp"} {
+		p := filepath.Join(board, "all", "4.0.0", name)
+		f, err := os.Create(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if name == ".foo.tmp.1234" {
+			if err := os.Chtimes(p, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return dst
+}
+
+func TestGC(t *testing.T) {
+	tests := []struct {
+		retention oppositus.Retention
+		removed   []string
+	}{
+		{
+			retention: oppositus.Retention{},
+			removed: []string{
+				"amd64-usr/all/.5.0.0.staging",
+				"amd64-usr/all/1.0.0",
+				"amd64-usr/all/2.0.0",
+				"amd64-usr/all/4.0.0/.foo.tmp.1234",
+				"amd64-usr/stable/2.0.0",
+			},
+		},
+		{
+			retention: oppositus.Retention{KeepLast: 3},
+			removed: []string{
+				"amd64-usr/all/.5.0.0.staging",
+				"amd64-usr/all/1.0.0",
+				"amd64-usr/all/4.0.0/.foo.tmp.1234",
+			},
+		},
+		{
+			retention: oppositus.Retention{KeepWithin: time.Hour},
+			removed: []string{
+				"amd64-usr/all/.5.0.0.staging",
+				"amd64-usr/all/1.0.0",
+				"amd64-usr/all/4.0.0/.foo.tmp.1234",
+			},
+		},
+		{
+			retention: oppositus.Retention{Pinned: []string{"<3"}},
+			removed: []string{
+				"amd64-usr/all/.5.0.0.staging",
+				"amd64-usr/all/4.0.0/.foo.tmp.1234",
+			},
+		},
+		{
+			retention: oppositus.Retention{Pinned: []string{"1.0.0"}},
+			removed: []string{
+				"amd64-usr/all/.5.0.0.staging",
+				"amd64-usr/all/2.0.0",
+				"amd64-usr/all/4.0.0/.foo.tmp.1234",
+				"amd64-usr/stable/2.0.0",
+			},
+		},
+	}
+
+	for i, test := range tests {
+		for _, dryRun := range []bool{true, false} {
+			dst := makeMirror(t)
+			removed, err := oppositus.GC(context.Background(), dst,
+				oppositus.WithRetention(test.retention),
+				oppositus.WithDryRun(dryRun),
+			)
+			if err != nil {
+				t.Errorf("#%d: gc: %v", i, err)
+				os.RemoveAll(dst)
+				continue
+			}
+			got := make([]string, 0, len(removed))
+			for _, p := range removed {
+				rel, err := filepath.Rel(dst, p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, filepath.ToSlash(rel))
+			}
+			sort.Strings(got)
+			if g, e := got, test.removed; !reflect.DeepEqual(g, e) {
+				t.Errorf("#%d: dry run %v: wrong removals: %q != %q", i, dryRun, g, e)
+			}
+			for _, p := range removed {
+				_, err := os.Lstat(p)
+				switch {
+				case dryRun && err != nil:
+					t.Errorf("#%d: dry run removed %v", i, p)
+				case !dryRun && !os.IsNotExist(err):
+					t.Errorf("#%d: not removed: %v: %v", i, p, err)
+				}
+			}
+			os.RemoveAll(dst)
+		}
+	}
+}
+
+func TestGCPartial(t *testing.T) {
+	dst := makeMirror(t)
+	defer os.RemoveAll(dst)
+	verPath := filepath.Join(dst, "amd64-usr", "all", "4.0.0")
+	old := time.Now().Add(-48 * time.Hour)
+	names := []string{
+		".old.bin.partial", ".old.bin.partial.validator",
+		".new.bin.partial", ".new.bin.partial.validator",
+	}
+	for _, name := range names {
+		p := filepath.Join(verPath, name)
+		f, err := os.Create(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if name[:4] == ".old" {
+			if err := os.Chtimes(p, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if _, err := oppositus.GC(context.Background(), dst, oppositus.WithRetention(oppositus.Retention{KeepLast: 4})); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	for _, name := range names {
+		_, err := os.Stat(filepath.Join(verPath, name))
+		if name[:4] == ".old" {
+			if !os.IsNotExist(err) {
+				t.Errorf("abandoned download not removed: %v: %v", name, err)
+			}
+		} else if err != nil {
+			// may still be resumed
+			t.Errorf("recent download removed: %v: %v", name, err)
+		}
+	}
+}
@@ -1,6 +1,6 @@
 module eagain.net/go/oppositus
 
-go 1.12
+go 1.13
 
 require (
 	github.com/google/shlex v0.0.0-20181106134648-c34317bd91bf
@@ -1,9 +1,13 @@
 package config
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 
 	"eagain.net/go/oppositus/channels"
 	"eagain.net/go/oppositus/internal/filters"
@@ -11,15 +15,384 @@ import (
 
 // Config describes what is to be mirrored.
 type Config struct {
+	// BaseURL is where releases are fetched from. It must contain
+	// the placeholder "{channel}", which is replaced by the channel
+	// name. If empty, mirror the official CoreOS release servers. A
+	// file URL reads from a local directory.
+	BaseURL string `json:"base_url"`
+
+	// Boards to mirror, such as "amd64-usr" and "arm64-usr". If nil,
+	// mirror only amd64-usr.
+	Boards []string `json:"boards"`
+
 	// Release channels to mirror. If nil, mirror all of Stable, Beta
 	// and Alpha.
 	Channels []channels.Channel `json:"channels"`
 
+	// Versions to mirror, besides the ones channels are currently
+	// at. Versions are selectors like "899.17.0" or ">=1010.0.0
+	// <1100", matched against the versions listed in each channel.
+	// Garbage collection never removes them.
+	Versions []string `json:"versions"`
+
+	// Backfill mirrors this many of the newest versions listed in
+	// every channel. Garbage collection keeps at least as many.
+	Backfill int `json:"backfill"`
+
 	// Filters choose what files are mirrored. By default, every file
 	// is mirrored. Filters are strings like "- GLOB" and "+ GLOB"
 	// that exclude and include files matching the globs,
 	// respectively. First matching filter applies.
 	Filters filters.Filters `json:"filters"`
+
+	// DigestedFiles mirrors files that have no signature, if a
+	// signed DIGESTS file lists their hashes, and they match.
+	DigestedFiles bool `json:"digested_files"`
+
+	// PartialVersions publishes versions, and moves channels to
+	// them, even if some of their files could not be mirrored.
+	PartialVersions bool `json:"partial_versions"`
+
+	// Concurrency is how many files are downloaded from every
+	// upstream host at the same time. If zero, download one at a
+	// time.
+	Concurrency int `json:"concurrency"`
+
+	// FileTimeout is how many seconds downloading a file may take,
+	// including retries but not waiting for its turn under
+	// Concurrency. If zero, there is no limit.
+	FileTimeout int `json:"file_timeout"`
+
+	// RunTimeout is how many seconds a whole run may take before it
+	// is aborted. If zero, there is no limit.
+	RunTimeout int `json:"run_timeout"`
+
+	// LockWait is how many seconds to wait for another run to
+	// finish with the destination. If zero, fail at once; if
+	// negative, wait as long as it takes.
+	LockWait int `json:"lock_wait"`
+
+	// HTTP configures how requests are made.
+	HTTP HTTP `json:"http"`
+
+	// Retry decides how failed requests are retried.
+	Retry Retry `json:"retry"`
+
+	// RateLimit limits the bandwidth used by downloads.
+	RateLimit RateLimit `json:"rate_limit"`
+
+	// GC decides what versions garbage collection keeps.
+	GC GC `json:"gc"`
+
+	// Quarantine keeps files that fail signature verification.
+	Quarantine Quarantine `json:"quarantine"`
+
+	// Storage is where the mirror is kept.
+	Storage Storage `json:"storage"`
+
+	// Trust decides what signatures are good.
+	Trust Trust `json:"trust"`
+}
+
+// Trust decides what signatures are good. By default, only the
+// CoreOS Image Signing Key is trusted.
+type Trust struct {
+	// Keyrings are files of public keys, armored or binary, to
+	// trust besides the CoreOS Image Signing Key.
+	Keyrings []string `json:"keyrings"`
+
+	// Keys, if set, are the only keys trusted, and when. Each must
+	// be the CoreOS Image Signing Key or in Keyrings.
+	Keys []Key `json:"keys"`
+}
+
+// Key says when a key is trusted.
+type Key struct {
+	// Fingerprint is the hex fingerprint of the primary key. Spaces
+	// are ignored.
+	Fingerprint string `json:"fingerprint"`
+
+	// NotBefore and NotAfter limit the signatures accepted to those
+	// made in between. If empty, there is no limit.
+	NotBefore Date `json:"not_before"`
+	NotAfter  Date `json:"not_after"`
+}
+
+// Date is a time like "2016-01-31", or "2016-01-31T12:00:00Z".
+// Dates without a time are midnight UTC.
+type Date time.Time
+
+// UnmarshalJSON parses a date or time.
+func (d *Date) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		if t, err := time.Parse(layout, s); err == nil {
+			*d = Date(t)
+			return nil
+		}
+	}
+	return fmt.Errorf("bad date: %q", s)
+}
+
+// Storage is where the mirror is kept: in the destination directory,
+// or in an S3-compatible object store.
+type Storage struct {
+	// Type is "file" or "s3". If empty, it is "file".
+	Type string `json:"type"`
+
+	// Endpoint is the URL of the object store, like
+	// "https://s3.eu-west-1.amazonaws.com".
+	Endpoint string `json:"endpoint"`
+	Bucket   string `json:"bucket"`
+	// Prefix is prepended to every key.
+	Prefix string `json:"prefix"`
+	// Region is what requests are signed for. If empty, it is
+	// us-east-1.
+	Region string `json:"region"`
+
+	// AccessKeyID and SecretAccessKey are the credentials. If
+	// neither is set, the environment variables AWS_ACCESS_KEY_ID
+	// and AWS_SECRET_ACCESS_KEY are used, and AWS_SESSION_TOKEN if
+	// set.
+	AccessKeyID     Secret `json:"access_key_id"`
+	SecretAccessKey Secret `json:"secret_access_key"`
+}
+
+// Quarantine keeps files that fail signature verification, as
+// evidence.
+type Quarantine struct {
+	// Dir is where the files are kept. If empty, they are deleted.
+	Dir string `json:"dir"`
+
+	// MaxBytes caps the size of Dir. If zero, the cap is 1 GiB.
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+// RateLimit limits the bandwidth used by all downloads together.
+type RateLimit struct {
+	// BytesPerSecond is the limit. If zero, there is no limit.
+	BytesPerSecond int64 `json:"bytes_per_second"`
+
+	// Windows are when the limit applies. If nil, it always does.
+	Windows []Window `json:"windows"`
+}
+
+// Window is a recurring period of local time, like
+// {"start": "08:00", "end": "18:00", "weekdays": ["mon", "tue"]}.
+type Window struct {
+	// Start and End are times of day. If End is not after Start,
+	// the window extends past midnight.
+	Start TimeOfDay `json:"start"`
+	End   TimeOfDay `json:"end"`
+
+	// Weekdays the window starts on. If nil, every day.
+	Weekdays []Weekday `json:"weekdays"`
+}
+
+// TimeOfDay is a time like "18:30", stored as the duration since
+// midnight.
+type TimeOfDay time.Duration
+
+// UnmarshalJSON parses a time of day like "18:30".
+func (t *TimeOfDay) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s == "24:00" {
+		*t = TimeOfDay(24 * time.Hour)
+		return nil
+	}
+	parsed, err := time.Parse("15:04", s)
+	if err != nil {
+		return fmt.Errorf("bad time of day: %q", s)
+	}
+	*t = TimeOfDay(time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute)
+	return nil
+}
+
+// Weekday is a day of the week, written like "mon".
+type Weekday time.Weekday
+
+// UnmarshalJSON parses the abbreviated name of a day.
+func (d *Weekday) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(s, day.String()[:3]) {
+			*d = Weekday(day)
+			return nil
+		}
+	}
+	return fmt.Errorf("bad weekday: %q", s)
+}
+
+// Retry is the retry policy for failed requests. Only transient
+// network errors and some HTTP statuses are retried, never bad
+// signatures or certificates.
+type Retry struct {
+	// Attempts is how many times a request is made at most. If zero,
+	// failed requests are not retried.
+	Attempts int `json:"attempts"`
+
+	// Backoff is how many seconds to wait before the first retry. The
+	// wait doubles for every further retry, up to MaxBackoff seconds
+	// if that is set.
+	Backoff    float64 `json:"backoff"`
+	MaxBackoff float64 `json:"max_backoff"`
+
+	// Jitter shortens every wait by a random fraction of up to this
+	// much, between 0 and 1.
+	Jitter float64 `json:"jitter"`
+
+	// Statuses are the HTTP response statuses that are retried. If
+	// nil, 408, 429, 500, 502, 503 and 504 are.
+	Statuses []int `json:"statuses"`
+}
+
+// HTTP configures the HTTP client.
+type HTTP struct {
+	// Proxy is the URL of the proxy to use, like
+	// "http://proxy.example.com:3128/". If empty, the environment
+	// variables HTTP_PROXY, HTTPS_PROXY and NO_PROXY are obeyed.
+	Proxy string `json:"proxy"`
+
+	// ConnectTimeout is how many seconds establishing a connection
+	// may take. If zero, there is no limit.
+	ConnectTimeout int `json:"connect_timeout"`
+
+	// ResponseHeaderTimeout is how many seconds to wait for the
+	// response headers of a request. If zero, there is no limit.
+	ResponseHeaderTimeout int `json:"response_header_timeout"`
+
+	// IdleTimeout is how many seconds a download may go without
+	// receiving data before it is aborted. If zero, there is no
+	// limit.
+	IdleTimeout int `json:"idle_timeout"`
+
+	// UserAgent is sent in every request. If empty, it is
+	// "oppositus/VERSION".
+	UserAgent string `json:"user_agent"`
+
+	// Upstreams hold credentials and TLS settings for the servers
+	// that need them.
+	Upstreams []Upstream `json:"upstreams"`
+}
+
+// Upstream holds the settings for requests to one upstream server.
+type Upstream struct {
+	// URL is where the settings apply, like
+	// "https://releases.example.com/". Requests to URLs under it use
+	// them; if more than one matches, the longest URL wins.
+	URL string `json:"url"`
+
+	Auth Auth `json:"auth"`
+	TLS  TLS  `json:"tls"`
+}
+
+// Auth is how requests authenticate: with HTTP basic authentication,
+// or with a bearer token. Secrets are never in the config file
+// itself.
+type Auth struct {
+	Username string `json:"username"`
+	Password Secret `json:"password"`
+	Token    Secret `json:"token"`
+}
+
+// Secret is read from a file, like {"file": "/etc/oppositus/token"},
+// or from an environment variable, like {"env": "RELEASES_TOKEN"}.
+type Secret struct {
+	File string `json:"file"`
+	Env  string `json:"env"`
+}
+
+// IsSet reports whether the secret comes from somewhere.
+func (s Secret) IsSet() bool {
+	return s.File != "" || s.Env != ""
+}
+
+// Read returns the secret. A trailing newline in the file is left
+// out.
+func (s Secret) Read() (string, error) {
+	if s.File != "" {
+		buf, err := ioutil.ReadFile(s.File)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(buf), "\r\n"), nil
+	}
+	if s.Env != "" {
+		v, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", s.Env)
+		}
+		return v, nil
+	}
+	return "", nil
+}
+
+// TLS configures the connections to an upstream server.
+type TLS struct {
+	// CAFile is a PEM bundle of the certificate authorities to
+	// trust, instead of the system ones.
+	CAFile string `json:"ca_file"`
+
+	// CertFile and KeyFile are the PEM client certificate and key
+	// to present.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+
+	// MinVersion is the lowest TLS version allowed, like "1.2".
+	MinVersion TLSVersion `json:"min_version"`
+
+	// PinSHA256 are base64 SHA-256 hashes of the subject public key
+	// info of certificates. If set, some certificate the server
+	// presents must have one of them.
+	PinSHA256 []string `json:"pin_sha256"`
+}
+
+// TLSVersion is a version of TLS, written like "1.2".
+type TLSVersion uint16
+
+// UnmarshalJSON parses a version like "1.2".
+func (v *TLSVersion) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	switch s {
+	case "1.0":
+		*v = tls.VersionTLS10
+	case "1.1":
+		*v = tls.VersionTLS11
+	case "1.2":
+		*v = tls.VersionTLS12
+	case "1.3":
+		*v = tls.VersionTLS13
+	default:
+		return fmt.Errorf("bad TLS version: %q", s)
+	}
+	return nil
+}
+
+// GC is the retention policy for garbage collection. Versions that a
+// channel is currently at are always kept.
+type GC struct {
+	// KeepLast keeps this many of the newest versions every channel
+	// has been at.
+	KeepLast int `json:"keep_last"`
+
+	// KeepDays keeps versions a channel has been at within this many
+	// days.
+	KeepDays int `json:"keep_days"`
+
+	// Pinned versions are never removed.
+	Pinned []string `json:"pinned"`
 }
 
 // Load a config from the given path.
@@ -34,5 +407,33 @@ func Load(path string) (*Config, error) {
 	if err := dec.Decode(&conf); err != nil {
 		return nil, fmt.Errorf("loading config: %v", err)
 	}
+	switch conf.Storage.Type {
+	case "", "file":
+	case "s3":
+		if conf.Storage.Endpoint == "" || conf.Storage.Bucket == "" {
+			return nil, fmt.Errorf("loading config: s3 storage needs endpoint and bucket")
+		}
+		if conf.Storage.AccessKeyID.IsSet() != conf.Storage.SecretAccessKey.IsSet() {
+			return nil, fmt.Errorf("loading config: s3 storage needs both access_key_id and secret_access_key, or neither")
+		}
+		for _, s := range []Secret{conf.Storage.AccessKeyID, conf.Storage.SecretAccessKey} {
+			if s.File != "" && s.Env != "" {
+				return nil, fmt.Errorf("loading config: s3 storage: secret must come from a file or the environment, not both")
+			}
+		}
+	default:
+		return nil, fmt.Errorf("loading config: unknown storage type: %q", conf.Storage.Type)
+	}
+	for _, up := range conf.HTTP.Upstreams {
+		a := up.Auth
+		if a.Token.IsSet() && (a.Username != "" || a.Password.IsSet()) {
+			return nil, fmt.Errorf("loading config: upstream %v: cannot use both basic auth and a token", up.URL)
+		}
+		for _, s := range []Secret{a.Password, a.Token} {
+			if s.File != "" && s.Env != "" {
+				return nil, fmt.Errorf("loading config: upstream %v: secret must come from a file or the environment, not both", up.URL)
+			}
+		}
+	}
 	return &conf, nil
 }
@@ -0,0 +1,87 @@
+// Package httpclient builds HTTP clients from the config file.
+package httpclient
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Options describe how to make requests.
+type Options struct {
+	// Proxy is the URL of the proxy to use. If empty, the proxy is
+	// taken from the environment variables HTTP_PROXY, HTTPS_PROXY
+	// and NO_PROXY.
+	Proxy string
+
+	// ConnectTimeout limits how long establishing a connection may
+	// take. If zero, there is no limit besides the operating
+	// system's.
+	ConnectTimeout time.Duration
+
+	// ResponseHeaderTimeout limits how long to wait for the response
+	// headers after sending the request. If zero, there is no limit.
+	ResponseHeaderTimeout time.Duration
+
+	// UserAgent is sent in every request. If empty, Go's default is
+	// used.
+	UserAgent string
+
+	// Upstreams hold credentials and TLS settings for the servers
+	// that need them.
+	Upstreams []Upstream
+}
+
+// New returns a client that makes requests as described by opts.
+func New(opts Options) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.Proxy != "" {
+		u, err := url.Parse(opts.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("bad proxy URL: %v", err)
+		}
+		if !u.IsAbs() || u.Host == "" {
+			return nil, fmt.Errorf("proxy URL must be absolute: %q", opts.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	if opts.ConnectTimeout > 0 {
+		dialer := &net.Dialer{
+			Timeout:   opts.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}
+		transport.DialContext = dialer.DialContext
+	}
+	transport.ResponseHeaderTimeout = opts.ResponseHeaderTimeout
+
+	var rt http.RoundTripper = transport
+	if len(opts.Upstreams) > 0 {
+		r, err := newUpstreams(transport, opts.Upstreams)
+		if err != nil {
+			return nil, err
+		}
+		rt = r
+	}
+	if opts.UserAgent != "" {
+		rt = &userAgent{rt: rt, ua: opts.UserAgent}
+	}
+	return &http.Client{Transport: rt}, nil
+}
+
+// userAgent sets the User-Agent header of requests that don't have
+// one.
+type userAgent struct {
+	rt http.RoundTripper
+	ua string
+}
+
+func (u *userAgent) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		// a RoundTripper must not modify the request
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", u.ua)
+	}
+	return u.rt.RoundTrip(req)
+}
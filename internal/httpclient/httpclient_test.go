@@ -0,0 +1,65 @@
+package httpclient_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"eagain.net/go/oppositus/internal/httpclient"
+)
+
+func TestUserAgent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(req.UserAgent()))
+	}))
+	defer srv.Close()
+
+	client, err := httpclient.New(httpclient.Options{UserAgent: "oppositus/1.2.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := string(buf), "oppositus/1.2.3"; g != e {
+		t.Errorf("wrong user agent: %q != %q", g, e)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// proxies get the absolute URL
+		_, _ = w.Write([]byte(req.URL.String()))
+	}))
+	defer proxy.Close()
+
+	client, err := httpclient.New(httpclient.Options{Proxy: proxy.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get("http://stable.release.example.com/amd64-usr/current/version.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := string(buf), "http://stable.release.example.com/amd64-usr/current/version.txt"; g != e {
+		t.Errorf("request did not go through proxy: %q != %q", g, e)
+	}
+}
+
+func TestBadProxy(t *testing.T) {
+	if _, err := httpclient.New(httpclient.Options{Proxy: "proxy.example.com:3128"}); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,208 @@
+package httpclient
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Upstream holds the settings for requests to one upstream server.
+type Upstream struct {
+	// URL is where the settings apply, like
+	// "https://releases.example.com/coreos/". Requests to URLs
+	// under it use them; if more than one Upstream matches, the
+	// longest URL wins.
+	URL string
+
+	Auth Auth
+	TLS  TLS
+}
+
+// Auth is how requests authenticate. At most one of Password and
+// Token may be set.
+type Auth struct {
+	// Username and Password are for HTTP basic authentication.
+	Username string
+	Password string
+
+	// Token is sent as a bearer token.
+	Token string
+}
+
+// String leaves out the secrets, in case Auth ends up in a log.
+func (a Auth) String() string {
+	switch {
+	case a.Token != "":
+		return "bearer token"
+	case a.Username != "" || a.Password != "":
+		return fmt.Sprintf("basic auth as %q", a.Username)
+	}
+	return "no auth"
+}
+
+// TLS configures the TLS connections.
+type TLS struct {
+	// CAFile is a PEM bundle of the certificate authorities to
+	// trust, instead of the system ones.
+	CAFile string
+
+	// CertFile and KeyFile are the PEM client certificate and key
+	// to present.
+	CertFile string
+	KeyFile  string
+
+	// MinVersion is the lowest TLS version allowed, like
+	// tls.VersionTLS12. If zero, Go's default is used.
+	MinVersion uint16
+
+	// PinnedSPKI are base64 SHA-256 hashes of the subject public key
+	// info of certificates. If set, some certificate in the
+	// verified chain must have one of them.
+	PinnedSPKI []string
+}
+
+// SPKIHash returns the pin of a certificate, for TLS.PinnedSPKI.
+func SPKIHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// config makes the TLS configuration, or nil if the defaults do.
+func (t *TLS) config() (*tls.Config, error) {
+	if t.CAFile == "" && t.CertFile == "" && t.KeyFile == "" && t.MinVersion == 0 && len(t.PinnedSPKI) == 0 {
+		return nil, nil
+	}
+	conf := &tls.Config{MinVersion: t.MinVersion}
+	if t.CAFile != "" {
+		buf, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no certificates in %v", t.CAFile)
+		}
+		conf.RootCAs = pool
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		if t.CertFile == "" || t.KeyFile == "" {
+			return nil, errors.New("client certificate needs both a certificate and a key")
+		}
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if len(t.PinnedSPKI) > 0 {
+		pins := make(map[string]bool)
+		for _, pin := range t.PinnedSPKI {
+			if buf, err := base64.StdEncoding.DecodeString(pin); err != nil || len(buf) != sha256.Size {
+				return nil, fmt.Errorf("bad SPKI pin: %q", pin)
+			}
+			pins[pin] = true
+		}
+		// only called after the usual verification, which gives
+		// the chains; sessions are never resumed without it, as
+		// there is no session cache
+		conf.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			for _, chain := range chains {
+				for _, cert := range chain {
+					if pins[SPKIHash(cert)] {
+						return nil
+					}
+				}
+			}
+			return errors.New("no pinned key in certificate chain")
+		}
+	}
+	return conf, nil
+}
+
+// upstream is an Upstream ready for use.
+type upstream struct {
+	u    *url.URL
+	auth Auth
+	rt   http.RoundTripper
+}
+
+// matches reports whether the request URL is under the upstream URL.
+func (up *upstream) matches(u *url.URL) bool {
+	p := u.Path
+	if p == "" {
+		p = "/"
+	}
+	return strings.EqualFold(u.Scheme, up.u.Scheme) &&
+		strings.EqualFold(u.Host, up.u.Host) &&
+		strings.HasPrefix(p, up.u.Path)
+}
+
+// upstreams sends requests through the transport of the upstream they
+// are for, with its credentials. Other requests go through the default
+// transport as is, so credentials never leak to other hosts, even on
+// redirects.
+type upstreams struct {
+	rt   http.RoundTripper
+	list []*upstream
+}
+
+func newUpstreams(base *http.Transport, list []Upstream) (*upstreams, error) {
+	r := &upstreams{rt: base}
+	for _, up := range list {
+		u, err := url.Parse(up.URL)
+		if err != nil {
+			return nil, fmt.Errorf("bad upstream URL: %v", err)
+		}
+		if !u.IsAbs() || u.Host == "" {
+			return nil, fmt.Errorf("upstream URL must be absolute: %q", up.URL)
+		}
+		if !strings.HasSuffix(u.Path, "/") {
+			u.Path += "/"
+		}
+		if up.Auth.Token != "" && (up.Auth.Username != "" || up.Auth.Password != "") {
+			return nil, fmt.Errorf("upstream %v: cannot use both basic auth and a token", up.URL)
+		}
+		conf, err := up.TLS.config()
+		if err != nil {
+			return nil, fmt.Errorf("upstream %v: %v", up.URL, err)
+		}
+		var rt http.RoundTripper = base
+		if conf != nil {
+			t := base.Clone()
+			t.TLSClientConfig = conf
+			rt = t
+		}
+		r.list = append(r.list, &upstream{u: u, auth: up.Auth, rt: rt})
+	}
+	return r, nil
+}
+
+func (r *upstreams) RoundTrip(req *http.Request) (*http.Response, error) {
+	var match *upstream
+	for _, up := range r.list {
+		if up.matches(req.URL) && (match == nil || len(up.u.Path) > len(match.u.Path)) {
+			match = up
+		}
+	}
+	if match == nil {
+		return r.rt.RoundTrip(req)
+	}
+	a := match.auth
+	if a.Token != "" || a.Username != "" || a.Password != "" {
+		// a RoundTripper must not modify the request
+		req = req.Clone(req.Context())
+		if a.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+a.Token)
+		} else {
+			req.SetBasicAuth(a.Username, a.Password)
+		}
+	}
+	return match.rt.RoundTrip(req)
+}
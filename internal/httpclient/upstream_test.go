@@ -0,0 +1,274 @@
+package httpclient_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"eagain.net/go/oppositus/internal/httpclient"
+)
+
+// echoAuth responds with the Authorization header of the request.
+var echoAuth = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+	_, _ = w.Write([]byte(req.Header.Get("Authorization")))
+})
+
+func get(t testing.TB, client *http.Client, u string) (string, error) {
+	resp, err := client.Get(u)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf), nil
+}
+
+func tempDir(t testing.TB) string {
+	dir, err := ioutil.TempDir("", "oppositus-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// writeCA writes the certificate of a test server as a PEM file.
+func writeCA(t testing.TB, dir string, srv *httptest.Server) string {
+	p := filepath.Join(dir, "ca.pem")
+	buf := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(p, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestAuth(t *testing.T) {
+	srv := httptest.NewServer(echoAuth)
+	defer srv.Close()
+	other := httptest.NewServer(echoAuth)
+	defer other.Close()
+
+	client, err := httpclient.New(httpclient.Options{
+		Upstreams: []httpclient.Upstream{
+			{URL: srv.URL + "/basic", Auth: httpclient.Auth{Username: "mirror", Password: "secret"}},
+			{URL: srv.URL + "/basic/token/", Auth: httpclient.Auth{Token: "t0ken"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url, auth string
+	}{
+		{srv.URL + "/basic/version.txt", "Basic bWlycm9yOnNlY3JldA=="},
+		{srv.URL + "/basic/token/version.txt", "Bearer t0ken"},
+		{srv.URL + "/basically", ""},
+		{srv.URL + "/", ""},
+		{other.URL + "/basic/version.txt", ""},
+	}
+	for _, test := range tests {
+		got, err := get(t, client, test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.auth {
+			t.Errorf("wrong auth for %v: %q != %q", test.url, got, test.auth)
+		}
+	}
+}
+
+func TestAuthNotLogged(t *testing.T) {
+	for _, a := range []httpclient.Auth{
+		{Username: "mirror", Password: "secret"},
+		{Token: "secret"},
+	} {
+		if s := a.String(); s == "" || strings.Contains(s, "secret") {
+			t.Errorf("secret in string: %q", s)
+		}
+	}
+}
+
+func TestCAFile(t *testing.T) {
+	srv := httptest.NewTLSServer(echoAuth)
+	defer srv.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	client, err := httpclient.New(httpclient.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(t, client, srv.URL); err == nil {
+		t.Fatal("untrusted certificate accepted")
+	}
+
+	client, err = httpclient.New(httpclient.Options{
+		Upstreams: []httpclient.Upstream{
+			{URL: srv.URL, TLS: httpclient.TLS{CAFile: writeCA(t, dir, srv)}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(t, client, srv.URL); err != nil {
+		t.Errorf("trusted certificate rejected: %v", err)
+	}
+}
+
+func TestPinnedSPKI(t *testing.T) {
+	srv := httptest.NewTLSServer(echoAuth)
+	defer srv.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ca := writeCA(t, dir, srv)
+
+	tests := []struct {
+		pin string
+		ok  bool
+	}{
+		{httpclient.SPKIHash(srv.Certificate()), true},
+		{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", false},
+	}
+	for _, test := range tests {
+		client, err := httpclient.New(httpclient.Options{
+			Upstreams: []httpclient.Upstream{
+				{URL: srv.URL, TLS: httpclient.TLS{CAFile: ca, PinnedSPKI: []string{test.pin}}},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = get(t, client, srv.URL)
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("pin %v: wrong result: %v", test.pin, err)
+		}
+	}
+}
+
+func TestBadPin(t *testing.T) {
+	_, err := httpclient.New(httpclient.Options{
+		Upstreams: []httpclient.Upstream{
+			{URL: "https://releases.example.com/", TLS: httpclient.TLS{PinnedSPKI: []string{"not a pin"}}},
+		},
+	})
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestMinVersion(t *testing.T) {
+	srv := httptest.NewUnstartedServer(echoAuth)
+	srv.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	srv.StartTLS()
+	defer srv.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	client, err := httpclient.New(httpclient.Options{
+		Upstreams: []httpclient.Upstream{
+			{URL: srv.URL, TLS: httpclient.TLS{CAFile: writeCA(t, dir, srv), MinVersion: tls.VersionTLS13}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(t, client, srv.URL); err == nil {
+		t.Error("old TLS version accepted")
+	}
+}
+
+// writeClientCert creates a self-signed client certificate, and
+// returns the paths of the certificate and key files.
+func writeClientCert(t testing.TB, dir string) (certFile, keyFile string, cert *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mirror"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = filepath.Join(dir, "client.pem")
+	keyFile = filepath.Join(dir, "client.key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestClientCert(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, cert := writeClientCert(t, dir)
+	clients := x509.NewCertPool()
+	clients.AddCert(cert)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte(req.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clients}
+	srv.StartTLS()
+	defer srv.Close()
+	ca := writeCA(t, dir, srv)
+
+	client, err := httpclient.New(httpclient.Options{
+		Upstreams: []httpclient.Upstream{
+			{URL: srv.URL, TLS: httpclient.TLS{CAFile: ca}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(t, client, srv.URL); err == nil {
+		t.Error("request without client certificate accepted")
+	}
+
+	client, err = httpclient.New(httpclient.Options{
+		Upstreams: []httpclient.Upstream{
+			{URL: srv.URL, TLS: httpclient.TLS{CAFile: ca, CertFile: certFile, KeyFile: keyFile}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := get(t, client, srv.URL)
+	if err != nil {
+		t.Fatalf("request with client certificate: %v", err)
+	}
+	if g, e := got, "mirror"; g != e {
+		t.Errorf("wrong client: %q != %q", g, e)
+	}
+}
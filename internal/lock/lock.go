@@ -0,0 +1,219 @@
+// Package lock implements advisory lock files that work across hosts
+// sharing a file system, such as over NFS.
+//
+// A lock file records the process holding it. A lock is stale, and
+// taken over, if the process was on this host and is gone, or if the
+// holder has not refreshed the lock file for a while, as happens when
+// it crashes on another host.
+package lock
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultStaleAfter is how long a lock may go without being refreshed
+// before it is considered stale, unless Options say otherwise.
+const DefaultStaleAfter = 10 * time.Minute
+
+// pollInterval is how often a held lock is tried again while waiting.
+const pollInterval = 250 * time.Millisecond
+
+// Owner tells who holds a lock.
+type Owner struct {
+	PID      int       `json:"pid"`
+	Hostname string    `json:"hostname"`
+	Time     time.Time `json:"time"`
+}
+
+// HeldError means the lock is held by someone else.
+type HeldError struct {
+	Path  string
+	Owner Owner
+}
+
+func (e *HeldError) Error() string {
+	return fmt.Sprintf("locked by pid %d on %s since %v: %s",
+		e.Owner.PID, e.Owner.Hostname, e.Owner.Time.Format(time.RFC3339), e.Path)
+}
+
+// Options control how a lock is taken.
+type Options struct {
+	// Wait is how long to wait for a lock held by someone else. If
+	// zero, Acquire fails at once; if negative, it waits until the
+	// context is done.
+	Wait time.Duration
+
+	// StaleAfter is how long a lock may go without being refreshed
+	// before it is taken over. The holder refreshes it four times
+	// as often. If not positive, DefaultStaleAfter is used.
+	StaleAfter time.Duration
+}
+
+// Lock is a held lock.
+type Lock struct {
+	path  string
+	owner Owner
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// Acquire creates the lock file at path. If someone else holds the
+// lock, the error is a *HeldError.
+func Acquire(ctx context.Context, path string, opts Options) (*Lock, error) {
+	staleAfter := opts.StaleAfter
+	if staleAfter <= 0 {
+		staleAfter = DefaultStaleAfter
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	owner := Owner{PID: os.Getpid(), Hostname: hostname}
+	var deadline <-chan time.Time
+	if opts.Wait > 0 {
+		t := time.NewTimer(opts.Wait)
+		defer t.Stop()
+		deadline = t.C
+	}
+	for {
+		owner.Time = time.Now()
+		err := create(path, owner)
+		if err == nil {
+			l := &Lock{
+				path:  path,
+				owner: owner,
+				stop:  make(chan struct{}),
+				done:  make(chan struct{}),
+			}
+			go l.refresh(staleAfter / 4)
+			return l, nil
+		}
+		herr, ok := err.(*HeldError)
+		if !ok {
+			return nil, err
+		}
+		stale, err := isStale(path, herr.Owner, hostname, staleAfter)
+		if err != nil {
+			return nil, err
+		}
+		if stale {
+			// if two of us notice at the same time, one may
+			// remove the lock the other just took; the window
+			// is small enough for the runs we guard against
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			continue
+		}
+		if opts.Wait == 0 {
+			return nil, herr
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-deadline:
+			return nil, herr
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// create makes the lock file, or returns a *HeldError if it exists.
+func create(path string, owner Owner) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		held, err := read(path)
+		if os.IsNotExist(err) {
+			// released meanwhile
+			return create(path, owner)
+		}
+		if err != nil {
+			return err
+		}
+		return &HeldError{Path: path, Owner: held}
+	}
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(owner)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	if _, err := f.Write(append(buf, '\n')); err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// read returns the owner recorded in the lock file. A file that
+// cannot be parsed, such as one still being written, has a zero
+// owner.
+func read(path string) (Owner, error) {
+	var owner Owner
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return owner, err
+	}
+	_ = json.Unmarshal(buf, &owner)
+	return owner, nil
+}
+
+// isStale tells whether the lock held by owner can be taken over.
+func isStale(path string, owner Owner, hostname string, staleAfter time.Duration) (bool, error) {
+	if owner.PID != 0 && owner.Hostname == hostname && !processExists(owner.PID) {
+		return true, nil
+	}
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return time.Since(fi.ModTime()) > staleAfter, nil
+}
+
+// refresh updates the modification time of the lock file, so others
+// can tell the holder is still around.
+func (l *Lock) refresh(interval time.Duration) {
+	defer close(l.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case now := <-t.C:
+			// errors show up again in Release
+			_ = os.Chtimes(l.path, now, now)
+		}
+	}
+}
+
+// Release removes the lock file, unless someone else has taken the
+// lock over meanwhile.
+func (l *Lock) Release() error {
+	close(l.stop)
+	<-l.done
+	owner, err := read(l.path)
+	if err != nil {
+		return err
+	}
+	if owner.PID != l.owner.PID || owner.Hostname != l.owner.Hostname || !owner.Time.Equal(l.owner.Time) {
+		return fmt.Errorf("lock was taken over by pid %d on %s: %s", owner.PID, owner.Hostname, l.path)
+	}
+	return os.Remove(l.path)
+}
@@ -0,0 +1,105 @@
+package lock_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"eagain.net/go/oppositus/internal/lock"
+	"golang.org/x/net/context"
+)
+
+func tempDir(t testing.TB) string {
+	dir, err := ioutil.TempDir("", "oppositus-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestAcquire(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, ".lock")
+
+	l, err := lock.Acquire(context.Background(), p, lock.Options{})
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	_, err = lock.Acquire(context.Background(), p, lock.Options{})
+	herr, ok := err.(*lock.HeldError)
+	if !ok {
+		t.Fatalf("expected the lock to be held: %v", err)
+	}
+	if g, e := herr.Owner.PID, os.Getpid(); g != e {
+		t.Errorf("wrong owner: %d != %d", g, e)
+	}
+
+	go func(l *lock.Lock) {
+		time.Sleep(100 * time.Millisecond)
+		if err := l.Release(); err != nil {
+			t.Errorf("release: %v", err)
+		}
+	}(l)
+	l, err = lock.Acquire(context.Background(), p, lock.Options{Wait: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("acquire after waiting: %v", err)
+	}
+	if err := l.Release(); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("lock file left behind: %v", err)
+	}
+}
+
+func TestAcquireStale(t *testing.T) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		owner lock.Owner
+		age   time.Duration
+		stale bool
+	}{
+		// still running
+		{owner: lock.Owner{PID: os.Getpid(), Hostname: hostname}, stale: false},
+		// gone; pids this high are not handed out
+		{owner: lock.Owner{PID: 1 << 30, Hostname: hostname}, stale: true},
+		// cannot tell from here
+		{owner: lock.Owner{PID: 1 << 30, Hostname: "elsewhere.example.com"}, stale: false},
+		// not refreshed
+		{owner: lock.Owner{PID: 1 << 30, Hostname: "elsewhere.example.com"}, age: time.Hour, stale: true},
+	}
+	for i, test := range tests {
+		dir := tempDir(t)
+		p := filepath.Join(dir, ".lock")
+		buf, err := json.Marshal(test.owner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if test.age > 0 {
+			old := time.Now().Add(-test.age)
+			if err := os.Chtimes(p, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+		l, err := lock.Acquire(context.Background(), p, lock.Options{})
+		if got := err == nil; got != test.stale {
+			t.Errorf("#%d: wrong outcome: %v", i, err)
+		}
+		if l != nil {
+			if err := l.Release(); err != nil {
+				t.Errorf("#%d: release: %v", i, err)
+			}
+		}
+		os.RemoveAll(dir)
+	}
+}
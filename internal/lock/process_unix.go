@@ -0,0 +1,14 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package lock
+
+import "syscall"
+
+// processExists reports whether a process with the pid exists on this
+// host.
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	// EPERM means it exists, but belongs to someone else
+	return err == nil || err == syscall.EPERM
+}
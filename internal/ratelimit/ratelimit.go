@@ -0,0 +1,68 @@
+// Package ratelimit limits bandwidth shared by many readers.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Limiter is a token bucket whose rate can change over time. It holds
+// at most one second worth of tokens.
+type Limiter struct {
+	rate func(now time.Time) int64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// New returns a limiter that allows rate(now) bytes per second. A
+// rate of zero or less means no limit.
+func New(rate func(now time.Time) int64) *Limiter {
+	return &Limiter{rate: rate}
+}
+
+// WaitN waits until n bytes may be transferred. The bytes are taken
+// into account even if ctx is canceled before then.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	delay := l.reserve(time.Now(), n)
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// reserve takes n bytes worth of tokens, and returns how long to wait
+// before using them.
+func (l *Limiter) reserve(now time.Time, n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rate := l.rate(now)
+	if rate <= 0 {
+		// start from empty once limiting begins again
+		l.tokens = 0
+		l.last = now
+		return 0
+	}
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+		if max := float64(rate); l.tokens > max {
+			l.tokens = max
+		}
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+}
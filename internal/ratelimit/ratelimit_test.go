@@ -0,0 +1,42 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"eagain.net/go/oppositus/internal/ratelimit"
+	"golang.org/x/net/context"
+)
+
+func TestWaitN(t *testing.T) {
+	l := ratelimit.New(func(time.Time) int64 { return 1000000 })
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if err := l.WaitN(context.Background(), 100000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 350*time.Millisecond || d > 2*time.Second {
+		t.Errorf("400 kB at 1 MB/s took %v", d)
+	}
+}
+
+func TestWaitNUnlimited(t *testing.T) {
+	l := ratelimit.New(func(time.Time) int64 { return 0 })
+	start := time.Now()
+	if err := l.WaitN(context.Background(), 1<<30); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("unlimited wait took %v", d)
+	}
+}
+
+func TestWaitNCanceled(t *testing.T) {
+	l := ratelimit.New(func(time.Time) int64 { return 1 })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := l.WaitN(ctx, 1000); err != context.DeadlineExceeded {
+		t.Errorf("wrong error: %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+// Package sigv4 signs HTTP requests with AWS Signature Version 4, as
+// understood by S3 and compatible object stores.
+package sigv4
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UnsignedPayload is the payload hash for requests whose body is not
+// signed.
+const UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// EmptyPayload is the payload hash of requests with no body.
+const EmptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+const (
+	algorithm  = "AWS4-HMAC-SHA256"
+	dateFormat = "20060102T150405Z"
+)
+
+// Credentials identify the signer.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is only set for temporary credentials.
+	SessionToken string
+}
+
+// PayloadHash returns the payload hash of body.
+func PayloadHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Sign sets the Authorization header of req, and the headers it
+// depends on. payloadHash is the hex SHA-256 of the body, or
+// UnsignedPayload. Every header already set is signed, except
+// User-Agent, which proxies may change.
+func Sign(req *http.Request, creds Credentials, region, service string, now time.Time, payloadHash string) {
+	stamp := now.UTC().Format(dateFormat)
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+	scope := strings.Join([]string{stamp[:8], region, service, "aws4_request"}, "/")
+	signedHeaders, canonicalHeaders := canonicalHeaders(req)
+	canonical := strings.Join([]string{
+		req.Method,
+		escape(req.URL.Path, false),
+		canonicalQuery(req),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{algorithm, stamp, scope, hex.EncodeToString(sum[:])}, "\n")
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{stamp[:8], region, service, "aws4_request"} {
+		key = mac(key, part)
+	}
+	signature := hex.EncodeToString(mac(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm, creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func mac(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func canonicalHeaders(req *http.Request) (signed, canonical string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "authorization" || name == "user-agent" {
+			continue
+		}
+		trimmed := make([]string, len(values))
+		for i, v := range values {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		headers[name] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + ":" + headers[name] + "\n")
+	}
+	return strings.Join(names, ";"), b.String()
+}
+
+func canonicalQuery(req *http.Request) string {
+	query := req.URL.Query()
+	var pairs []string
+	for name, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, escape(name, true)+"="+escape(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// escape percent-encodes everything but unreserved characters, and
+// slashes unless slash is true.
+func escape(s string, slash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+	return b.String()
+}
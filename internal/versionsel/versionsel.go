@@ -0,0 +1,107 @@
+// Package versionsel selects CoreOS versions with expressions like
+// "899.17.0" or ">=1010.0.0 <1100".
+package versionsel
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"eagain.net/go/oppositus/versionfile"
+)
+
+type op int
+
+const (
+	eq op = iota
+	lt
+	le
+	gt
+	ge
+)
+
+// ops are tried in order, so prefixes of others must come later.
+var ops = []struct {
+	s  string
+	op op
+}{
+	{"==", eq},
+	{"<=", le},
+	{">=", ge},
+	{"=", eq},
+	{"<", lt},
+	{">", gt},
+}
+
+type constraint struct {
+	op      op
+	version string
+}
+
+func (c constraint) match(version string) bool {
+	cmp := versionfile.Compare(version, c.version)
+	switch c.op {
+	case lt:
+		return cmp < 0
+	case le:
+		return cmp <= 0
+	case gt:
+		return cmp > 0
+	case ge:
+		return cmp >= 0
+	}
+	return cmp == 0
+}
+
+// Selector matches versions. It is a list of whitespace-separated
+// constraints, all of which must match. A constraint is a version
+// optionally prefixed by one of the operators =, ==, <, <=, > and >=.
+type Selector struct {
+	s           string
+	constraints []constraint
+}
+
+// Parse parses a selector.
+func Parse(s string) (Selector, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return Selector{}, errors.New("empty version selector")
+	}
+	sel := Selector{s: s}
+	for _, f := range fields {
+		c := constraint{op: eq, version: f}
+		for _, o := range ops {
+			if strings.HasPrefix(f, o.s) {
+				c = constraint{op: o.op, version: f[len(o.s):]}
+				break
+			}
+		}
+		if c.version == "" {
+			return Selector{}, fmt.Errorf("version selector has no version: %q", s)
+		}
+		sel.constraints = append(sel.constraints, c)
+	}
+	return sel, nil
+}
+
+// Match reports whether version is selected.
+func (s Selector) Match(version string) bool {
+	for _, c := range s.constraints {
+		if !c.match(version) {
+			return false
+		}
+	}
+	return true
+}
+
+// Exact returns the version, if the selector matches exactly one.
+func (s Selector) Exact() (version string, ok bool) {
+	if len(s.constraints) != 1 || s.constraints[0].op != eq {
+		return "", false
+	}
+	return s.constraints[0].version, true
+}
+
+func (s Selector) String() string {
+	return s.s
+}
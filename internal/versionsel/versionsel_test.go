@@ -0,0 +1,85 @@
+package versionsel_test
+
+import (
+	"testing"
+
+	"eagain.net/go/oppositus/internal/versionsel"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		sel     string
+		version string
+		want    bool
+	}{
+		{"899.17.0", "899.17.0", true},
+		{"899.17.0", "899.15.0", false},
+		{"=899.17.0", "899.17.0", true},
+		{"==899.17.0", "899.17.0", true},
+		{">=1010.0.0", "1010.0.0", true},
+		{">=1010.0.0", "1010.3.0", true},
+		{">=1010.0.0", "899.17.0", false},
+		{">1010.0.0", "1010.0.0", false},
+		{"<1010.0.0", "899.17.0", true},
+		{"<=899.17.0", "899.17.0", true},
+		{">=1010.0.0 <1100", "1010.3.0", true},
+		{">=1010.0.0 <1100", "1122.2.0", false},
+	}
+
+	for _, test := range tests {
+		sel, err := versionsel.Parse(test.sel)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.sel, err)
+			continue
+		}
+		if g, e := sel.Match(test.version), test.want; g != e {
+			t.Errorf("%q: wrong match for %q: %v != %v", test.sel, test.version, g, e)
+		}
+	}
+}
+
+func TestExact(t *testing.T) {
+	tests := []struct {
+		sel     string
+		version string
+		ok      bool
+	}{
+		{"899.17.0", "899.17.0", true},
+		{"=899.17.0", "899.17.0", true},
+		{">=899.17.0", "", false},
+		{"899.17.0 899.17.0", "", false},
+	}
+
+	for _, test := range tests {
+		sel, err := versionsel.Parse(test.sel)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.sel, err)
+			continue
+		}
+		version, ok := sel.Exact()
+		if version != test.version || ok != test.ok {
+			t.Errorf("%q: wrong exact: %q, %v", test.sel, version, ok)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		sel, err string
+	}{
+		{"", "empty version selector"},
+		{" ", "empty version selector"},
+		{">=", `version selector has no version: ">="`},
+	}
+
+	for _, test := range tests {
+		_, err := versionsel.Parse(test.sel)
+		if err == nil {
+			t.Errorf("%q: expected an error", test.sel)
+			continue
+		}
+		if g, e := err.Error(), test.err; g != e {
+			t.Errorf("%q: wrong error: %q != %q", test.sel, g, e)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package oppositus
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// hostLimiter bounds the number of simultaneous requests to every
+// host.
+type hostLimiter struct {
+	n int
+
+	mu    sync.Mutex
+	hosts map[string]chan struct{}
+}
+
+func newHostLimiter(n int) *hostLimiter {
+	return &hostLimiter{
+		n:     n,
+		hosts: make(map[string]chan struct{}),
+	}
+}
+
+func (l *hostLimiter) sem(host string) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sem, ok := l.hosts[host]
+	if !ok {
+		sem = make(chan struct{}, l.n)
+		l.hosts[host] = sem
+	}
+	return sem
+}
+
+// acquire waits for a free slot for host. The caller must call the
+// returned function once it is done with the host.
+func (l *hostLimiter) acquire(ctx context.Context, host string) (release func(), err error) {
+	sem := l.sem(host)
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
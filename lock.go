@@ -0,0 +1,76 @@
+package oppositus
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"eagain.net/go/oppositus/internal/lock"
+	"golang.org/x/net/context"
+)
+
+// lockName is the lock file in the destination directory.
+const lockName = ".lock"
+
+// LockedError means another run holds the lock on the destination
+// directory.
+type LockedError struct {
+	// Path is the lock file.
+	Path     string
+	PID      int
+	Hostname string
+	Since    time.Time
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("destination is locked by pid %d on %s since %v: %s",
+		e.PID, e.Hostname, e.Since.Format(time.RFC3339), e.Path)
+}
+
+// WithLockWait sets how long to wait for another run to finish with
+// the destination directory. If negative, wait until the context is
+// done. By default, fail at once with a *LockedError.
+//
+// Mirror, GC and Verify lock the destination with the file ".lock" in
+// it, recording the process ID and host name. A lock left behind by a
+// process that is gone from this host, or not refreshed for
+// lock.DefaultStaleAfter by one on another host, is taken over.
+func WithLockWait(d time.Duration) Option {
+	return func(conf *config) error {
+		conf.lockWait = d
+		return nil
+	}
+}
+
+// lockDst locks the destination directory, creating it if create is
+// true. The returned function releases the lock, passing errors to
+// the error handler. A destination that does not exist and is not
+// created needs no lock.
+func lockDst(ctx context.Context, conf *config, dst string, create bool) (release func(), err error) {
+	if create {
+		if err := os.MkdirAll(dst, 0755); err != nil {
+			return nil, err
+		}
+	} else if _, err := os.Stat(dst); os.IsNotExist(err) {
+		return func() {}, nil
+	}
+	l, err := lock.Acquire(ctx, filepath.Join(dst, lockName), lock.Options{Wait: conf.lockWait})
+	if err != nil {
+		if herr, ok := err.(*lock.HeldError); ok {
+			return nil, &LockedError{
+				Path:     herr.Path,
+				PID:      herr.Owner.PID,
+				Hostname: herr.Owner.Hostname,
+				Since:    herr.Owner.Time,
+			}
+		}
+		return nil, err
+	}
+	release = func() {
+		if err := l.Release(); err != nil {
+			_ = conf.errFn(err)
+		}
+	}
+	return release, nil
+}
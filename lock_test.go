@@ -0,0 +1,146 @@
+package oppositus_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"eagain.net/go/oppositus"
+	"eagain.net/go/oppositus/channels"
+	"golang.org/x/net/context"
+)
+
+// holdLock makes it look like another live process holds the lock on
+// dst.
+func holdLock(t testing.TB, dst string) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := json.Marshal(map[string]interface{}{
+		"pid":      os.Getpid(),
+		"hostname": hostname,
+		"time":     time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dst, ".lock")
+	if err := ioutil.WriteFile(p, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLocked(t *testing.T) {
+	srv := newUpstream(t, upstreamFiles(t))
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+	holdLock(t, dst)
+
+	calls := []struct {
+		name string
+		fn   func() error
+	}{
+		{"mirror", func() error {
+			_, err := oppositus.Mirror(context.Background(), dst,
+				oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+				oppositus.WithChannels(channels.Stable),
+			)
+			return err
+		}},
+		{"gc", func() error {
+			_, err := oppositus.GC(context.Background(), dst)
+			return err
+		}},
+		{"verify", func() error {
+			_, err := oppositus.Verify(context.Background(), dst)
+			return err
+		}},
+	}
+	for _, c := range calls {
+		err := c.fn()
+		lerr, ok := err.(*oppositus.LockedError)
+		if !ok {
+			t.Errorf("%s: expected a lock error: %v", c.name, err)
+			continue
+		}
+		if g, e := lerr.PID, os.Getpid(); g != e {
+			t.Errorf("%s: wrong pid: %d != %d", c.name, g, e)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "amd64-usr")); !os.IsNotExist(err) {
+		t.Errorf("mirrored despite the lock: %v", err)
+	}
+}
+
+func TestLockWait(t *testing.T) {
+	srv := newUpstream(t, upstreamFiles(t))
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+	p := holdLock(t, dst)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_ = os.Remove(p)
+	}()
+	_, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+		oppositus.WithLockWait(10*time.Second),
+	)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "amd64-usr", "all", testVersion, "version.txt")); err != nil {
+		t.Errorf("not mirrored: %v", err)
+	}
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Errorf("lock left behind: %v", err)
+	}
+}
+
+func TestPlanHoldsLock(t *testing.T) {
+	srv := newUpstream(t, upstreamFiles(t))
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+	opts := []oppositus.Option{
+		oppositus.WithBaseURL(srv.URL + "/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+	}
+
+	plan, err := oppositus.Prepare(context.Background(), dst, opts...)
+	if err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	if _, err := oppositus.Prepare(context.Background(), dst, opts...); err == nil {
+		t.Fatalf("prepared while another plan holds the lock")
+	} else if _, ok := err.(*oppositus.LockedError); !ok {
+		t.Fatalf("expected a lock error: %v", err)
+	}
+	if _, err := plan.Execute(context.Background()); err != nil {
+		t.Fatalf("execute: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, ".lock")); !os.IsNotExist(err) {
+		t.Errorf("lock left behind: %v", err)
+	}
+
+	// executing again locks anew, and still reports if it cannot
+	holdLock(t, dst)
+	rep, err := plan.Execute(context.Background())
+	if _, ok := err.(*oppositus.LockedError); !ok {
+		t.Errorf("expected a lock error: %v", err)
+	}
+	if rep == nil {
+		t.Fatalf("no report")
+	}
+	if g, e := len(rep.Channels), 1; g != e {
+		t.Errorf("wrong channels: %d != %d", g, e)
+	}
+}
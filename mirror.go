@@ -1,45 +1,108 @@
 package oppositus
 
 import (
+	"errors"
 	"fmt"
-	"io"
-	"log"
-	"net/url"
+	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"eagain.net/go/oppositus/channels"
-	"eagain.net/go/oppositus/internal/atomic"
-	"eagain.net/go/oppositus/internal/href"
+	"eagain.net/go/oppositus/internal/ratelimit"
+	"eagain.net/go/oppositus/internal/versionsel"
 	"eagain.net/go/oppositus/sig"
-	"eagain.net/go/oppositus/versionfile"
+	"eagain.net/go/oppositus/source"
 	"golang.org/x/net/context"
-	"golang.org/x/net/context/ctxhttp"
 )
 
-const defaultBaseURL = "http://release.core-os.net/amd64-usr/"
-
-var baseURL *url.URL
-
-func init() {
-	var err error
-	baseURL, err = url.Parse(defaultBaseURL)
-	if err != nil {
-		panic(err)
-	}
-}
-
 // Option is passed to Mirror to change its behavior.
 type Option option
 
 type option func(*config) error
 
 type config struct {
-	chans  []channels.Channel
-	filter func(basename string) bool
-	errFn  func(error) error
+	baseURL urlTemplate
+	boards  []string
+	chans   []channels.Channel
+	filter  func(basename string) bool
+	errFn   func(error) error
+
+	concurrency int
+	observer    func(Event)
+	client      *http.Client
+	source      source.Source
+	retry       RetryPolicy
+	rateLimit   *ratelimit.Limiter
+	idleTimeout time.Duration
+	fileTimeout time.Duration
+	runTimeout  time.Duration
+	digested    bool
+	quarantine  *sig.Quarantine
+	verifier    *sig.Verifier
+	storage     Storage
+	partial     bool
+	lockWait    time.Duration
+
+	versions []versionsel.Selector
+	backfill int
+
+	retention Retention
+	dryRun    bool
+}
+
+// WithBaseURL sets where releases are fetched from. The URL must
+// contain the placeholder "{channel}", which is replaced by the name
+// of the release channel; this allows both host-prefix layouts like
+// "http://{channel}.release.core-os.net/{board}/" (the default) and
+// path-prefix layouts like "https://mirror.example.com/{channel}/".
+//
+// The placeholder "{board}" is replaced by the board name. It is only
+// required when mirroring more than one board.
+//
+// A file URL like "file:///media/usb/{channel}/" reads releases from
+// a local directory with the same layout, such as another mirror.
+func WithBaseURL(base string) Option {
+	return func(conf *config) error {
+		t, err := parseURLTemplate(base)
+		if err != nil {
+			return err
+		}
+		conf.baseURL = t
+		return nil
+	}
+}
+
+// WithBoards sets the boards, that is architectures such as
+// "amd64-usr" or "arm64-usr", to mirror. Caller must not mutate
+// boards after the call.
+func WithBoards(boards ...string) Option {
+	return func(conf *config) error {
+		for _, board := range boards {
+			if err := checkBoard(board); err != nil {
+				return err
+			}
+		}
+		conf.boards = boards
+		return nil
+	}
+}
+
+func checkBoard(board string) error {
+	// make sure it's safe to use as a path/url segment
+	if board == "" {
+		return errors.New("board name cannot be empty")
+	}
+	if strings.HasPrefix(board, ".") {
+		return fmt.Errorf("board name cannot begin with a dot: %q", board)
+	}
+	if strings.Contains(board, "/") {
+		return fmt.Errorf("board name cannot contain a slash: %q", board)
+	}
+	return nil
 }
 
 // WithChannels sets the channels to mirror. Caller must not mutate
@@ -64,6 +127,9 @@ func WithFilter(fn func(basename string) bool) Option {
 // fatal. If it returns a non-nil error, the mirroring process aborts;
 // otherwise, as much progress is made as possible.
 //
+// The function is never called concurrently, even though mirroring
+// happens in parallel.
+//
 // A typical use would be to log errors and return nil.
 func WithErrorHandler(fn func(error) error) Option {
 	return func(conf *config) error {
@@ -72,153 +138,433 @@ func WithErrorHandler(fn func(error) error) Option {
 	}
 }
 
-// Mirror fetches CoreOS releases, verifies signatures, and stores
-// them locally under the directory dst.
-func Mirror(ctx context.Context, dst string, opts ...Option) error {
-	conf := config{
-		chans: channels.All(),
+// WithVersions adds versions to mirror, besides the ones channels are
+// currently at. Versions are given as selectors like "899.17.0" or
+// ">=1010.0.0 <1100", and looked up from the directory listings of
+// the channels.
+func WithVersions(selectors ...string) Option {
+	return func(conf *config) error {
+		for _, s := range selectors {
+			sel, err := versionsel.Parse(s)
+			if err != nil {
+				return err
+			}
+			conf.versions = append(conf.versions, sel)
+		}
+		return nil
+	}
+}
+
+// WithBackfill also mirrors the n newest versions listed in every
+// channel, not just the one it is currently at.
+func WithBackfill(n int) Option {
+	return func(conf *config) error {
+		if n < 0 {
+			return fmt.Errorf("backfill cannot be negative: %d", n)
+		}
+		conf.backfill = n
+		return nil
+	}
+}
+
+// WithConcurrency sets how many files are downloaded from every
+// upstream host at the same time. A file keeps its slot while it is
+// retried. Boards and channels are always mirrored in parallel. The
+// default is 1.
+func WithConcurrency(n int) Option {
+	return func(conf *config) error {
+		if n < 1 {
+			return fmt.Errorf("concurrency must be at least 1: %d", n)
+		}
+		conf.concurrency = n
+		return nil
+	}
+}
+
+// WithHTTPClient sets the HTTP client used for all requests. The
+// default is http.DefaultClient. It is ignored if WithSource is used.
+func WithHTTPClient(client *http.Client) Option {
+	return func(conf *config) error {
+		conf.client = client
+		return nil
+	}
+}
+
+func newConfig(opts []Option) (*config, error) {
+	conf := &config{
+		baseURL:     defaultBaseURL,
+		boards:      []string{defaultBoard},
+		chans:       channels.All(),
+		concurrency: 1,
+		filter:      func(string) bool { return true },
+		errFn:       func(err error) error { return err },
+		observer:    logEvent,
 	}
 	for _, opt := range opts {
-		if err := opt(&conf); err != nil {
-			return err
+		if err := opt(conf); err != nil {
+			return nil, err
 		}
 	}
-	for _, channel := range conf.chans {
-		if err := mirrorChannel(ctx, dst, conf.filter, conf.errFn, channel); err != nil {
-			if err := conf.errFn(err); err != nil {
-				return err
+	return conf, nil
+}
+
+// Mirror fetches CoreOS releases, verifies signatures, and stores
+// them locally under the directory dst. It is the same as Prepare
+// followed by Execute, and returns a report of what was done.
+//
+// Every board gets its own subdirectory, with versions stored in
+// "<board>/all/<version>" and shared by all channels of that board.
+// The version a channel is at is recorded as the symlink
+// "<board>/<channel>/current".
+//
+// The destination is locked for the whole call, so that runs do not
+// race; see WithLockWait.
+func Mirror(ctx context.Context, dst string, opts ...Option) (*Report, error) {
+	plan, err := Prepare(ctx, dst, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return plan.Execute(ctx)
+}
+
+// Execute downloads the missing files of the plan, and then updates
+// the channel symlinks. Errors are passed to the handler set with
+// WithErrorHandler. The report is returned even if mirroring was
+// aborted, or could not start at all.
+//
+// Execute releases the lock taken by Prepare. A plan executed again,
+// or after Close, locks the destination anew.
+func (p *Plan) Execute(ctx context.Context) (*Report, error) {
+	rep := newReporter(p)
+	if p.conf.dryRun {
+		return rep.report(p), errors.New("cannot execute a plan prepared for a dry run")
+	}
+	if p.release == nil {
+		release, err := lockDst(ctx, p.conf, p.dst, true)
+		if err != nil {
+			return rep.report(p), err
+		}
+		p.release = release
+	}
+	defer p.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	m := newMirrorer(p.conf, p.dst, cancel)
+	defer m.abortAt(p.started)()
+	m.obs.fn = func(ev Event) {
+		rep.observe(ev)
+		p.conf.observer(ev)
+	}
+	for i, c := range p.Channels {
+		current, err := m.currentVersion(ctx, c)
+		if err != nil {
+			if err := m.errs.handle(err); err != nil {
+				return rep.report(p), err
 			}
 			continue
 		}
+		rep.setPrevious(i, current)
 	}
-	return nil
+
+	var wg sync.WaitGroup
+	for _, v := range p.Versions {
+		wg.Add(1)
+		go func(v *VersionPlan) {
+			defer wg.Done()
+			if err := m.mirrorVersion(ctx, v); err != nil {
+				_ = m.errs.handle(err)
+				return
+			}
+			for i, c := range p.Channels {
+				if c.Version == v {
+					if err := m.updateChannel(ctx, c); err != nil {
+						_ = m.errs.handle(err)
+						continue
+					}
+					rep.setUpdated(i)
+				}
+				for _, h := range c.History {
+					if h == v {
+						if err := m.addHistory(ctx, c, v); err != nil {
+							_ = m.errs.handle(err)
+						}
+					}
+				}
+			}
+		}(v)
+	}
+	wg.Wait()
+	return rep.report(p), m.errs.err()
 }
 
-func mirrorChannel(ctx context.Context, dst string, filter func(string) bool, errFn func(error) error, channel channels.Channel) error {
-	chanURL := new(url.URL)
-	*chanURL = *baseURL
-	chanURL.Host = channel.String() + "." + chanURL.Host
+// errorHandler serializes calls to the error handler set with
+// WithErrorHandler, and aborts all work on the first fatal error.
+type errorHandler struct {
+	fn     func(error) error
+	cancel func()
 
-	current := chanURL.ResolveReference(&url.URL{Path: "current/version.txt"})
-	resp, err := ctxhttp.Get(ctx, nil, current.String())
-	if err != nil {
-		return fmt.Errorf("cannot fetch channel %v: %v", channel, err)
-	}
-	defer resp.Body.Close()
+	mu    sync.Mutex
+	fatal error
+}
 
-	version, err := versionfile.ParseVersionID(resp.Body)
-	if err != nil {
+// handle passes err to the error handler, and returns non-nil if
+// mirroring must abort.
+func (h *errorHandler) handle(err error) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.fatal != nil {
+		// already aborting; errors now are most likely just
+		// consequences of that
+		return h.fatal
+	}
+	if err := h.fn(err); err != nil {
+		h.fatal = err
+		h.cancel()
 		return err
 	}
+	return nil
+}
+
+// abort passes err to the error handler, and aborts mirroring
+// whatever the handler says.
+func (h *errorHandler) abort(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.fatal != nil {
+		return
+	}
+	_ = h.fn(err)
+	h.fatal = err
+	h.cancel()
+}
 
-	// make separate subdir for every channel, but share versions across them
+// err returns the fatal error that aborted mirroring, if any.
+func (h *errorHandler) err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.fatal
+}
 
-	allPath := filepath.Join(dst, "all")
-	if err := os.Mkdir(allPath, 0755); err != nil && !os.IsExist(err) {
-		return err
+// mirrorer holds the state of one Prepare or Execute call.
+type mirrorer struct {
+	conf    *config
+	dst     string
+	limiter *hostLimiter
+	errs    *errorHandler
+	obs     *observer
+	source  source.Source
+	storage Storage
+}
+
+// newMirrorer prepares for mirroring into dst. Fatal errors call
+// cancel.
+func newMirrorer(conf *config, dst string, cancel func()) *mirrorer {
+	m := &mirrorer{
+		conf:    conf,
+		dst:     dst,
+		limiter: newHostLimiter(conf.concurrency),
+		errs:    &errorHandler{fn: conf.errFn, cancel: cancel},
+		obs:     &observer{fn: conf.observer},
+		source:  conf.source,
+		storage: conf.storage,
 	}
-	verPath := filepath.Join(allPath, version)
-	if err := os.Mkdir(verPath, 0755); err != nil && !os.IsExist(err) {
-		return err
+	if m.source == nil {
+		m.source = defaultSource(conf, filepath.Join(dst, cacheDir))
 	}
-	log.Printf("channel %v is at version %v", channel, version)
-	verURL := chanURL.ResolveReference(&url.URL{Path: version + "/"})
-	if err := mirrorVersion(ctx, verPath, verURL, filter, errFn); err != nil {
-		return err
+	if m.storage == nil {
+		m.storage = &fileStorage{root: dst}
+	}
+	return m
+}
+
+// currentVersion returns the version the channel is at, or "" if it
+// has not been mirrored before.
+func (m *mirrorer) currentVersion(ctx context.Context, c ChannelPlan) (string, error) {
+	target, err := m.storage.Pointer(ctx, path.Join(c.Board, c.Channel.String(), currentLink))
+	if target == "" || err != nil {
+		return "", err
+	}
+	return path.Base(target), nil
+}
+
+// updateChannel makes the channel point to its planned version.
+func (m *mirrorer) updateChannel(ctx context.Context, c ChannelPlan) error {
+	chanDir := path.Join(c.Board, c.Channel.String())
+	updated := func(name, target string) {
+		m.obs.observe(&SymlinkUpdated{Board: c.Board, Channel: c.Channel, Name: name, Target: target})
 	}
+	return updateChannel(ctx, m.storage, chanDir, c.Version.Version, updated)
+}
 
-	chanPath := filepath.Join(dst, channel.String())
-	if err := os.Mkdir(chanPath, 0755); err != nil && !os.IsExist(err) {
+// addHistory records that the channel has been at version v, without
+// changing what it is at currently.
+func (m *mirrorer) addHistory(ctx context.Context, c ChannelPlan, v *VersionPlan) error {
+	link := path.Join(c.Board, c.Channel.String(), v.Version)
+	old, err := m.storage.Pointer(ctx, link)
+	if err != nil || old != "" {
+		// keep the timestamp telling when the channel was last
+		// seen at the version
 		return err
 	}
-	// create a symlink from current to the version dir
-	if err := atomic.Symlink(path.Join("..", "all", version), path.Join(dst, channel.String(), "current")); err != nil {
+	target := path.Join("..", "all", v.Version)
+	if err := m.storage.SetPointer(ctx, link, target); err != nil {
 		return err
 	}
+	m.obs.observe(&SymlinkUpdated{Board: c.Board, Channel: c.Channel, Name: v.Version, Target: target})
 	return nil
 }
 
-// mirrorVersion downloads the CoreOS version at u into path, while
-// checking signatures.
-func mirrorVersion(ctx context.Context, dst string, u *url.URL, filter func(string) bool, errFn func(error) error) error {
-	log.Printf("mirroring %v", u)
+// Names of the symlinks in a channel directory that are not
+// versions.
+const (
+	currentLink  = "current"
+	previousLink = "previous"
+)
 
-	// fetch directory listing
-	resp, err := ctxhttp.Get(ctx, nil, u.String())
-	if err != nil {
+// updateChannel records that the channel directory chanDir is at
+// version. Every version the channel has been at gets a pointer named
+// after it, and the pointers "current" and "previous" point to the
+// latest two. Every pointer set is passed to updated.
+func updateChannel(ctx context.Context, s Storage, chanDir string, version string, updated func(name, target string)) error {
+	if version == currentLink || version == previousLink {
+		return fmt.Errorf("version ID cannot be %q", version)
+	}
+	target := path.Join("..", "all", version)
+
+	// recreate the pointer even if it exists, so its timestamp
+	// tells when the channel was last seen at the version
+	if err := s.SetPointer(ctx, path.Join(chanDir, version), target); err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	updated(version, target)
 
-	hrefs := href.New(resp.Body)
-	for {
-		link, err := hrefs.Next()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
+	old, err := s.Pointer(ctx, path.Join(chanDir, currentLink))
+	if err != nil {
+		return err
+	}
+	if old != "" && old != target {
+		if err := s.SetPointer(ctx, path.Join(chanDir, previousLink), old); err != nil {
 			return err
 		}
+		updated(previousLink, old)
+	}
 
-		if err := mirrorFile(ctx, dst, u, link, filter); err != nil {
-			if err := errFn(err); err != nil {
-				return err
-			}
-			continue
-		}
+	// point current to the version dir
+	if err := s.SetPointer(ctx, path.Join(chanDir, currentLink), target); err != nil {
+		return err
 	}
+	updated(currentLink, target)
 	return nil
 }
 
-func mirrorFile(ctx context.Context, dst string, u *url.URL, link string, filter func(string) bool) error {
-	rel, err := url.Parse(link)
-	if err != nil {
+// mirrorVersion downloads the missing files of the version, while
+// checking signatures, and publishes the version once it is
+// complete.
+func (m *mirrorer) mirrorVersion(ctx context.Context, v *VersionPlan) error {
+	m.obs.observe(&VersionStarted{Board: v.Board, Version: v.Version, URL: v.URL})
+	err := m.mirrorFiles(ctx, v)
+	m.obs.observe(&VersionCompleted{Board: v.Board, Version: v.Version, Err: err})
+	return err
+}
+
+func (m *mirrorer) mirrorFiles(ctx context.Context, v *VersionPlan) error {
+	// make separate subdir for every channel, but share versions across them
+	if err := os.MkdirAll(v.local, 0755); err != nil {
 		return err
 	}
-	if rel.Scheme != "" || rel.Opaque != "" || rel.Host != "" || strings.HasPrefix(rel.Path, "/") {
-		// skip non-relative links
-		return nil
-	}
-	if strings.Contains(rel.Path, "/") {
-		// skip links to other directories
-		return nil
-	}
-	if strings.HasPrefix(rel.Path, ".") {
-		// skip links to hidden files (we use them for our own
-		// purposes) or other directories (the ".." case, without
-		// slash
-		return nil
+
+	var (
+		wg         sync.WaitGroup
+		mu         sync.Mutex
+		downloaded = make(map[string]bool)
+	)
+	for _, f := range v.Files {
+		if f.Present || f.Unsigned {
+			continue
+		}
+		wg.Add(1)
+		go func(f FilePlan) {
+			defer wg.Done()
+			if err := m.mirrorFile(ctx, v, f); err != nil {
+				_ = m.errs.handle(err)
+				return
+			}
+			mu.Lock()
+			downloaded[f.Name] = true
+			mu.Unlock()
+		}(f)
 	}
-	if rel.RawQuery != "" || rel.Fragment != "" {
-		// skip things that don't look like links to static files
-		return nil
+	wg.Wait()
+	if err := m.errs.err(); err != nil {
+		return err
 	}
-
-	const sigExt = ".sig"
-	if !strings.HasSuffix(rel.Path, sigExt) {
-		// we only download signed things, so filter out
-		// everything that isn't a signature
-		return nil
+	if err := m.checkDigests(ctx, v, downloaded); err != nil {
+		return err
 	}
-	rel.Path = rel.Path[:len(rel.Path)-len(sigExt)]
-
-	if !filter(rel.Path) {
-		return nil
+	if err := m.mirrorUnsigned(ctx, v, downloaded); err != nil {
+		return err
 	}
+	return m.publish(ctx, v, downloaded)
+}
 
-	// see if we have it already; files are considered immutable
-	if _, err := os.Stat(path.Join(dst, rel.Path)); !os.IsNotExist(err) {
-		if err != nil {
-			return err
+func (m *mirrorer) mirrorFile(ctx context.Context, v *VersionPlan, f FilePlan) error {
+	err := m.download(ctx, v, f, func(ctx context.Context, d *sig.Downloader) error {
+		return d.Download(ctx, v.local, f.URL)
+	})
+	if err != nil {
+		if _, ok := err.(*sig.SignatureError); ok {
+			m.obs.observe(&SignatureFailed{Board: v.Board, Version: v.Version, Name: f.Name, Err: err})
+		} else {
+			m.obs.observe(&DownloadFailed{Board: v.Board, Version: v.Version, Name: f.Name, Err: err})
 		}
-		// got it already
-		return nil
+		return err
 	}
+	m.obs.observe(&SignatureVerified{Board: v.Board, Version: v.Version, Name: f.Name})
+	return nil
+}
 
-	log.Printf("downloading %v", rel.Path)
-	u2 := u.ResolveReference(rel)
-	if err := sig.Download(ctx, dst, u2); err != nil {
+// download calls fn with a Downloader set up for the file, obeying the
+// per-host concurrency limit, the retry policy and the file timeout.
+func (m *mirrorer) download(ctx context.Context, v *VersionPlan, f FilePlan, fn func(ctx context.Context, d *sig.Downloader) error) error {
+	// waiting for a slot does not count against the file timeout
+	release, err := m.limiter.acquire(ctx, f.URL.Host)
+	if err != nil {
 		return err
 	}
-	return nil
+	defer release()
+	m.obs.observe(&DownloadStarted{Board: v.Board, Version: v.Version, Name: f.Name})
+	// bytes fetched by earlier attempts, and where the current one
+	// started and is at
+	var done, start, at int64
+	d := sig.Downloader{
+		Source:      m.source,
+		IdleTimeout: m.conf.idleTimeout,
+		Quarantine:  m.conf.quarantine,
+		Verifier:    m.conf.verifier,
+		Started: func(offset int64) {
+			done += at - start
+			start, at = offset, offset
+		},
+		Progress: func(n, total int64) {
+			at = n
+			m.obs.observe(&DownloadProgress{Board: v.Board, Version: v.Version, Name: f.Name, Bytes: n, Total: total, Transferred: done + n - start})
+		},
+	}
+	if m.conf.rateLimit != nil {
+		d.RateLimit = m.conf.rateLimit
+	}
+	fileCtx := ctx
+	if m.conf.fileTimeout > 0 {
+		var cancel func()
+		fileCtx, cancel = context.WithTimeout(ctx, m.conf.fileTimeout)
+		defer cancel()
+	}
+	// retries resume from where the previous attempt stopped
+	err = m.retry(fileCtx, f.URL, func() error {
+		return fn(fileCtx, &d)
+	})
+	if err != nil && ctx.Err() == nil && fileCtx.Err() == context.DeadlineExceeded {
+		err = &FileTimeoutError{URL: f.URL, Timeout: m.conf.fileTimeout}
+	}
+	return err
 }
@@ -0,0 +1,508 @@
+package oppositus_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"eagain.net/go/oppositus"
+	"eagain.net/go/oppositus/channels"
+	"golang.org/x/net/context"
+)
+
+const testVersion = "899.15.0"
+
+func readTestdata(t testing.TB, name string) []byte {
+	buf, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func tempDir(t testing.TB) string {
+	dir, err := ioutil.TempDir("", "oppositus-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// assertNotPublished checks that the errors handled are a single
+// failure, and the *IncompleteError it caused for the version, and
+// that no channel of the board was moved to the version. It returns
+// the failure.
+func assertNotPublished(t testing.TB, dst, board, version string, errs []error) error {
+	if len(errs) != 2 {
+		t.Fatalf("wrong errors: %v", errs)
+	}
+	ierr, ok := errs[1].(*oppositus.IncompleteError)
+	if !ok || ierr.Board != board || ierr.Version != version {
+		t.Errorf("version not left incomplete: %v", errs[1])
+	}
+	links, err := filepath.Glob(filepath.Join(dst, board, "*", "current"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range links {
+		if target, err := os.Readlink(link); err == nil && filepath.Base(target) == version {
+			t.Errorf("channel moved to incomplete version: %v", link)
+		}
+	}
+	return errs[0]
+}
+
+// addUpstreamFiles adds to files the contents of a fake release
+// channel at testVersion, under the path prefix.
+func addUpstreamFiles(t testing.TB, files map[string][]byte, prefix string) {
+	version := readTestdata(t, "version.txt")
+	signature := readTestdata(t, "version.txt.sig")
+	files[prefix+"/current/version.txt"] = version
+	files[prefix+"/"+testVersion+"/version.txt"] = version
+	files[prefix+"/"+testVersion+"/version.txt.sig"] = signature
+}
+
+// upstreamFiles returns the files of a fake release server, where
+// the stable channel is at testVersion.
+func upstreamFiles(t testing.TB) map[string][]byte {
+	files := make(map[string][]byte)
+	addUpstreamFiles(t, files, "stable")
+	return files
+}
+
+// upstream is a fake release server.
+type upstream struct {
+	*httptest.Server
+	dir string
+
+	mu       sync.Mutex
+	requests map[string]int
+	failures map[string]int
+	hangs    map[string]bool
+	delays   map[string]time.Duration
+}
+
+// hangOn makes requests for path with method never get a response.
+func (u *upstream) hangOn(method, path string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.hangs[method+" "+path] = true
+}
+
+// delay makes requests for path with method wait d before getting a
+// response.
+func (u *upstream) delay(method, path string, d time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.delays[method+" "+path] = d
+}
+
+// failNext makes the next n requests for path with method fail with
+// 503 Service Unavailable.
+func (u *upstream) failNext(method, path string, n int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures[method+" "+path] = n
+}
+
+// count returns how many times path was requested with method.
+func (u *upstream) count(method, path string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.requests[method+" "+path]
+}
+
+func (u *upstream) Close() {
+	u.Server.Close()
+	_ = os.RemoveAll(u.dir)
+}
+
+// newUpstream serves files with a path-prefix layout, and with
+// directory listings like the real release servers have.
+func newUpstream(t testing.TB, files map[string][]byte) *upstream {
+	dir := tempDir(t)
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u := &upstream{
+		dir:      dir,
+		requests: make(map[string]int),
+		failures: make(map[string]int),
+		hangs:    make(map[string]bool),
+		delays:   make(map[string]time.Duration),
+	}
+	fs := http.FileServer(http.Dir(dir))
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		key := req.Method + " " + req.URL.Path
+		u.mu.Lock()
+		u.requests[key]++
+		fail := u.failures[key] > 0
+		if fail {
+			u.failures[key]--
+		}
+		hang := u.hangs[key]
+		delay := u.delays[key]
+		u.mu.Unlock()
+		if hang {
+			<-req.Context().Done()
+			return
+		}
+		time.Sleep(delay)
+		if fail {
+			http.Error(w, "try again later", http.StatusServiceUnavailable)
+			return
+		}
+		fs.ServeHTTP(w, req)
+	}))
+	return u
+}
+
+func TestMirror(t *testing.T) {
+	srv := newUpstream(t, upstreamFiles(t))
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	_, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+	)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+
+	for _, name := range []string{"version.txt", "version.txt.sig"} {
+		if _, err := os.Stat(filepath.Join(dst, "amd64-usr", "all", testVersion, name)); err != nil {
+			t.Errorf("not mirrored: %v", err)
+		}
+	}
+	target, err := os.Readlink(filepath.Join(dst, "amd64-usr", "stable", "current"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := target, "../all/"+testVersion; g != e {
+		t.Errorf("wrong current symlink: %q != %q", g, e)
+	}
+}
+
+func TestMirrorBoards(t *testing.T) {
+	files := make(map[string][]byte)
+	addUpstreamFiles(t, files, "amd64-usr/stable")
+	addUpstreamFiles(t, files, "arm64-usr/stable")
+	addUpstreamFiles(t, files, "arm64-usr/beta")
+	srv := newUpstream(t, files)
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	_, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{board}/{channel}/"),
+		oppositus.WithBoards("amd64-usr", "arm64-usr"),
+		oppositus.WithChannels(channels.Stable, channels.Beta),
+		oppositus.WithErrorHandler(func(err error) error {
+			// amd64-usr has no beta
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+
+	for _, board := range []string{"amd64-usr", "arm64-usr"} {
+		p := filepath.Join(dst, board, "all", testVersion, "version.txt")
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("not mirrored: %v", err)
+		}
+	}
+	for _, link := range []string{"amd64-usr/stable/current", "arm64-usr/stable/current", "arm64-usr/beta/current"} {
+		target, err := os.Readlink(filepath.Join(dst, filepath.FromSlash(link)))
+		if err != nil {
+			t.Errorf("missing symlink: %v", err)
+			continue
+		}
+		if g, e := target, "../all/"+testVersion; g != e {
+			t.Errorf("wrong symlink %v: %q != %q", link, g, e)
+		}
+	}
+}
+
+func TestMirrorConcurrency(t *testing.T) {
+	files := make(map[string][]byte)
+	for _, channel := range channels.All() {
+		addUpstreamFiles(t, files, channel.String())
+	}
+	srv := newUpstream(t, files)
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	_, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithConcurrency(4),
+	)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+
+	for _, channel := range channels.All() {
+		target, err := os.Readlink(filepath.Join(dst, "amd64-usr", channel.String(), "current"))
+		if err != nil {
+			t.Errorf("missing symlink: %v", err)
+			continue
+		}
+		if g, e := target, "../all/"+testVersion; g != e {
+			t.Errorf("wrong symlink for %v: %q != %q", channel, g, e)
+		}
+	}
+
+	// all channels are at the same version, so only one of them
+	// should have downloaded it
+	var n int
+	for _, channel := range channels.All() {
+		n += srv.count("GET", "/"+channel.String()+"/"+testVersion+"/version.txt")
+	}
+	if n != 1 {
+		t.Errorf("version was downloaded %d times", n)
+	}
+}
+
+// countingTransport counts the requests it makes.
+type countingTransport struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	c.n++
+	c.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestMirrorHTTPClient(t *testing.T) {
+	srv := newUpstream(t, upstreamFiles(t))
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	transport := &countingTransport{}
+	_, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+		oppositus.WithHTTPClient(&http.Client{Transport: transport}),
+	)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	var total int
+	srv.mu.Lock()
+	for _, n := range srv.requests {
+		total += n
+	}
+	srv.mu.Unlock()
+	if total == 0 {
+		t.Fatal("no requests made")
+	}
+	if g, e := transport.n, total; g != e {
+		t.Errorf("not all requests used the client: %d != %d", g, e)
+	}
+}
+
+func TestWithBoardsNeedsPlaceholder(t *testing.T) {
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	_, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL("http://{channel}.release.example.com/"),
+		oppositus.WithBoards("amd64-usr", "arm64-usr"),
+	)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if g, e := err.Error(), `base URL must contain {board} to mirror multiple boards: "http://{channel}.release.example.com/"`; g != e {
+		t.Errorf("wrong error: %q != %q", g, e)
+	}
+}
+
+func TestMirrorHistory(t *testing.T) {
+	srv := newUpstream(t, upstreamFiles(t))
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	// pretend an earlier run saw stable at an older version
+	chanPath := filepath.Join(dst, "amd64-usr", "stable")
+	if err := os.MkdirAll(chanPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../all/800.0.0", filepath.Join(chanPath, "800.0.0")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../all/800.0.0", filepath.Join(chanPath, "current")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+	)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+
+	links := map[string]string{
+		"current":   "../all/" + testVersion,
+		"previous":  "../all/800.0.0",
+		"800.0.0":   "../all/800.0.0",
+		testVersion: "../all/" + testVersion,
+	}
+	for name, want := range links {
+		target, err := os.Readlink(filepath.Join(chanPath, name))
+		if err != nil {
+			t.Errorf("missing symlink: %v", err)
+			continue
+		}
+		if g, e := target, want; g != e {
+			t.Errorf("wrong symlink %v: %q != %q", name, g, e)
+		}
+	}
+}
+
+func TestMirrorHistoricalVersions(t *testing.T) {
+	tests := []struct {
+		opt     oppositus.Option
+		history []string
+	}{
+		{oppositus.WithBackfill(1), nil},
+		{oppositus.WithBackfill(2), []string{"800.0.0"}},
+		{oppositus.WithVersions("800.0.0"), []string{"800.0.0"}},
+		{oppositus.WithVersions("<899"), []string{"700.0.0", "800.0.0"}},
+	}
+
+	files := upstreamFiles(t)
+	for _, version := range []string{"700.0.0", "800.0.0"} {
+		files["stable/"+version+"/version.txt"] = files["stable/"+testVersion+"/version.txt"]
+		files["stable/"+version+"/version.txt.sig"] = files["stable/"+testVersion+"/version.txt.sig"]
+	}
+	srv := newUpstream(t, files)
+	defer srv.Close()
+
+	for i, test := range tests {
+		dst := tempDir(t)
+		_, err := oppositus.Mirror(context.Background(), dst,
+			oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+			oppositus.WithChannels(channels.Stable),
+			test.opt,
+		)
+		if err != nil {
+			t.Errorf("#%d: mirror: %v", i, err)
+			os.RemoveAll(dst)
+			continue
+		}
+
+		chanPath := filepath.Join(dst, "amd64-usr", "stable")
+		for _, version := range append([]string{testVersion}, test.history...) {
+			if _, err := os.Stat(filepath.Join(chanPath, version, "version.txt")); err != nil {
+				t.Errorf("#%d: not mirrored: %v", i, err)
+			}
+		}
+		target, err := os.Readlink(filepath.Join(chanPath, "current"))
+		if err != nil {
+			t.Errorf("#%d: missing current: %v", i, err)
+		} else if g, e := target, "../all/"+testVersion; g != e {
+			t.Errorf("#%d: wrong current: %q != %q", i, g, e)
+		}
+		if _, err := os.Lstat(filepath.Join(chanPath, "previous")); !os.IsNotExist(err) {
+			t.Errorf("#%d: history must not set previous: %v", i, err)
+		}
+		versions, err := ioutil.ReadDir(filepath.Join(dst, "amd64-usr", "all"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g, e := len(versions), 1+len(test.history); g != e {
+			t.Errorf("#%d: wrong number of versions: %d != %d", i, g, e)
+		}
+		os.RemoveAll(dst)
+	}
+}
+
+func TestMirrorVersionNotFound(t *testing.T) {
+	srv := newUpstream(t, upstreamFiles(t))
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	_, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+		oppositus.WithVersions("700.0.0"),
+	)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if g, e := err.Error(), "version 700.0.0 not found in any channel of board amd64-usr"; g != e {
+		t.Errorf("wrong error: %q != %q", g, e)
+	}
+}
+
+func TestMirrorBadSignature(t *testing.T) {
+	files := upstreamFiles(t)
+	files["stable/"+testVersion+"/version.txt"] = []byte("junk\n")
+	srv := newUpstream(t, files)
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	var errs []error
+	_, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+		oppositus.WithErrorHandler(func(err error) error {
+			errs = append(errs, err)
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	if len(errs) != 2 {
+		t.Fatalf("expected two errors: %v", errs)
+	}
+	if _, ok := errs[1].(*oppositus.IncompleteError); !ok {
+		t.Errorf("version not incomplete: %v", errs[1])
+	}
+	for _, name := range []string{"version.txt", "version.txt.sig"} {
+		if _, err := os.Stat(filepath.Join(dst, "amd64-usr", "all", "."+testVersion+".staging", name)); !os.IsNotExist(err) {
+			t.Errorf("file with bad signature was stored: %v: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "amd64-usr", "all", testVersion)); !os.IsNotExist(err) {
+		t.Errorf("incomplete version was published: %v", err)
+	}
+}
+
+func TestWithBaseURLNeedsChannel(t *testing.T) {
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	_, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL("http://release.example.com/amd64-usr/"),
+	)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if g, e := err.Error(), `base URL must contain {channel}: "http://release.example.com/amd64-usr/"`; g != e {
+		t.Errorf("wrong error: %q != %q", g, e)
+	}
+}
@@ -0,0 +1,544 @@
+package oppositus
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"eagain.net/go/oppositus/channels"
+	"eagain.net/go/oppositus/versionfile"
+	"golang.org/x/net/context"
+)
+
+// Plan describes what mirroring would do: what versions the channels
+// are at, and what files would be downloaded. Use Prepare to make
+// one, and Execute to carry it out. The plan holds the lock on the
+// destination until Execute returns or Close is called, so that
+// another run cannot make it stale in between.
+type Plan struct {
+	// Channels lists the channels that were resolved to a version.
+	// Channels that could not be resolved were passed to the error
+	// handler, and are not listed.
+	Channels []ChannelPlan
+	// Versions lists the versions to mirror. A version shared by
+	// several channels of a board is listed only once.
+	Versions []*VersionPlan
+
+	dst  string
+	conf *config
+	// when Prepare was called, for WithRunTimeout
+	started time.Time
+	// releases the lock taken by Prepare; nil once released
+	release func()
+}
+
+// ChannelPlan says what version a channel of a board is at.
+type ChannelPlan struct {
+	Board   string
+	Channel channels.Channel
+	Version *VersionPlan
+	// History lists older versions of the channel that were
+	// selected with WithVersions or WithBackfill. They are mirrored
+	// and linked from the channel directory, but do not change what
+	// the channel is currently at.
+	History []*VersionPlan
+}
+
+// VersionPlan lists the files of a version that pass the filter.
+type VersionPlan struct {
+	Board   string
+	Version string
+	URL     *url.URL
+	Files   []FilePlan
+	// Published is true if the version has been committed to the
+	// storage before. Otherwise, it is only published once it is
+	// complete.
+	Published bool
+
+	// local is the directory files are downloaded into.
+	local string
+	// listed is true if Files lists every file of the version.
+	listed bool
+}
+
+// FilePlan describes a file in a version.
+type FilePlan struct {
+	// Name is the basename of the file. The signature is the same
+	// with ".sig" appended.
+	Name string
+	// Unsigned is true if the file has no signature. It is only
+	// downloaded if a signed DIGESTS file covers it; see
+	// WithDigestedFiles.
+	Unsigned bool
+	URL      *url.URL
+	// Size is the size of the file in bytes, or -1 if unknown.
+	// Signatures are not included. The sizes of missing files are
+	// only looked up with WithDryRun.
+	Size int64
+	// Present is true if the file has already been mirrored, and
+	// will not be downloaded.
+	Present bool
+}
+
+// Bytes returns the number of bytes the plan would download, not
+// counting signatures or files of unknown size. It is only useful
+// for plans prepared with WithDryRun.
+func (p *Plan) Bytes() int64 {
+	var n int64
+	for _, v := range p.Versions {
+		for _, f := range v.Files {
+			if !f.Present && f.Size > 0 {
+				n += f.Size
+			}
+		}
+	}
+	return n
+}
+
+// dir returns the path of the version in the storage.
+func (v *VersionPlan) dir() string {
+	return path.Join(v.Board, "all", v.Version)
+}
+
+// Prepare figures out what Mirror would do, without downloading
+// anything but channel version files and directory listings. Errors
+// are passed to the handler set with WithErrorHandler, and whatever
+// failed is left out of the plan.
+//
+// The destination stays locked until the plan is executed or closed.
+// With WithDryRun, the sizes of missing files are looked up too, and
+// a destination that does not exist is left alone.
+func Prepare(ctx context.Context, dst string, opts ...Option) (*Plan, error) {
+	conf, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(conf.boards) > 1 && !conf.baseURL.hasBoard() {
+		return nil, fmt.Errorf("base URL must contain %s to mirror multiple boards: %q", boardPlaceholder, conf.baseURL)
+	}
+	// a dry run leaves no trace of a destination that does not
+	// exist yet
+	missing := false
+	if conf.dryRun {
+		_, err := os.Stat(dst)
+		missing = os.IsNotExist(err)
+	}
+	release, err := lockDst(ctx, conf, dst, !conf.dryRun)
+	if err != nil {
+		return nil, err
+	}
+	// handed over to the plan on success
+	defer func() {
+		if release != nil {
+			release()
+		}
+	}()
+	started := time.Now()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	m := newMirrorer(conf, dst, cancel)
+	if missing && conf.source == nil {
+		m.source = defaultSource(conf, "")
+	}
+	defer m.abortAt(started)()
+	plan := &Plan{
+		dst:     dst,
+		conf:    conf,
+		started: started,
+	}
+
+	// resolve channels in parallel, but keep them in order
+	type resolved struct {
+		board   string
+		channel channels.Channel
+		chanURL *url.URL
+		version string
+		// older versions of the channel that were selected
+		history []string
+		// index in plan.Channels
+		idx int
+	}
+	var chans []*resolved
+	for _, board := range conf.boards {
+		for _, channel := range conf.chans {
+			chans = append(chans, &resolved{board: board, channel: channel})
+		}
+	}
+	wantHistory := len(conf.versions) > 0 || conf.backfill > 0
+	var wg sync.WaitGroup
+	for _, r := range chans {
+		wg.Add(1)
+		go func(r *resolved) {
+			defer wg.Done()
+			chanURL, version, err := m.resolveChannel(ctx, r.board, r.channel)
+			if err != nil {
+				_ = m.errs.handle(err)
+				return
+			}
+			r.chanURL = chanURL
+			r.version = version
+			if !wantHistory {
+				return
+			}
+			history, err := m.listVersions(ctx, chanURL)
+			if err != nil {
+				_ = m.errs.handle(fmt.Errorf("cannot list channel %v/%v: %v", r.board, r.channel, err))
+				return
+			}
+			for _, h := range conf.selectVersions(history) {
+				if h != version {
+					r.history = append(r.history, h)
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+	if err := m.errs.err(); err != nil {
+		return nil, err
+	}
+
+	// share versions across channels of a board
+	versions := make(map[string]*VersionPlan)
+	getVersion := func(board string, chanURL *url.URL, version string) *VersionPlan {
+		key := board + "/" + version
+		v, ok := versions[key]
+		if !ok {
+			v = &VersionPlan{
+				Board:   board,
+				Version: version,
+				URL:     chanURL.ResolveReference(&url.URL{Path: version + "/"}),
+			}
+			versions[key] = v
+			plan.Versions = append(plan.Versions, v)
+		}
+		return v
+	}
+	for _, r := range chans {
+		if r.version == "" {
+			continue
+		}
+		r.idx = len(plan.Channels)
+		plan.Channels = append(plan.Channels, ChannelPlan{
+			Board:   r.board,
+			Channel: r.channel,
+			Version: getVersion(r.board, r.chanURL, r.version),
+		})
+	}
+	// history after current versions, so they come first in the
+	// plan
+	for _, r := range chans {
+		for _, h := range r.history {
+			c := &plan.Channels[r.idx]
+			c.History = append(c.History, getVersion(r.board, r.chanURL, h))
+		}
+	}
+	for _, sel := range conf.versions {
+		version, ok := sel.Exact()
+		if !ok {
+			continue
+		}
+		for _, board := range conf.boards {
+			if _, found := versions[board+"/"+version]; !found {
+				if err := m.errs.handle(fmt.Errorf("version %v not found in any channel of board %v", version, board)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	var mu sync.Mutex
+	failed := make(map[*VersionPlan]bool)
+	for _, v := range plan.Versions {
+		wg.Add(1)
+		go func(v *VersionPlan) {
+			defer wg.Done()
+			if err := m.planVersion(ctx, v); err != nil {
+				_ = m.errs.handle(err)
+				mu.Lock()
+				failed[v] = true
+				mu.Unlock()
+			}
+		}(v)
+	}
+	wg.Wait()
+	if err := m.errs.err(); err != nil {
+		return nil, err
+	}
+	plan.drop(failed)
+	plan.release, release = release, nil
+	return plan, nil
+}
+
+// drop leaves out the versions that could not be planned, and the
+// channels at them.
+func (p *Plan) drop(failed map[*VersionPlan]bool) {
+	if len(failed) == 0 {
+		return
+	}
+	var versions []*VersionPlan
+	for _, v := range p.Versions {
+		if !failed[v] {
+			versions = append(versions, v)
+		}
+	}
+	p.Versions = versions
+	var chans []ChannelPlan
+	for _, c := range p.Channels {
+		if failed[c.Version] {
+			continue
+		}
+		var history []*VersionPlan
+		for _, h := range c.History {
+			if !failed[h] {
+				history = append(history, h)
+			}
+		}
+		c.History = history
+		chans = append(chans, c)
+	}
+	p.Channels = chans
+}
+
+// Close releases the lock on the destination, for a plan that will
+// not be executed. It is safe to call more than once, and after
+// Execute.
+func (p *Plan) Close() {
+	if p.release != nil {
+		p.release()
+		p.release = nil
+	}
+}
+
+// resolveChannel finds out what version a channel of a board is at.
+func (m *mirrorer) resolveChannel(ctx context.Context, board string, channel channels.Channel) (*url.URL, string, error) {
+	chanURL, err := m.conf.baseURL.channel(board, channel)
+	if err != nil {
+		return nil, "", err
+	}
+
+	current := chanURL.ResolveReference(&url.URL{Path: "current/version.txt"})
+	buf, err := m.fetch(ctx, current)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot fetch channel %v/%v: %v", board, channel, err)
+	}
+	version, err := versionfile.ParseVersionID(bytes.NewReader(buf))
+	if err != nil {
+		return nil, "", err
+	}
+	m.obs.observe(&ChannelResolved{Board: board, Channel: channel, Version: version})
+	return chanURL, version, nil
+}
+
+// listVersions finds the versions in the directory listing of a
+// channel.
+func (m *mirrorer) listVersions(ctx context.Context, chanURL *url.URL) ([]string, error) {
+	links, err := m.list(ctx, chanURL)
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for _, link := range links {
+		if version, ok := versionDir(link); ok {
+			versions = append(versions, version)
+		}
+	}
+	return versions, nil
+}
+
+// versionDir decides whether the link in a channel directory listing
+// is to a version directory, and returns the version.
+func versionDir(link string) (version string, ok bool) {
+	rel, err := url.Parse(link)
+	if err != nil {
+		return "", false
+	}
+	if rel.Scheme != "" || rel.Opaque != "" || rel.Host != "" || rel.RawQuery != "" || rel.Fragment != "" {
+		return "", false
+	}
+	if !strings.HasSuffix(rel.Path, "/") {
+		return "", false
+	}
+	version = rel.Path[:len(rel.Path)-1]
+	// make sure it's safe to use as a path/url segment
+	if version == "" || strings.HasPrefix(version, ".") || strings.Contains(version, "/") {
+		return "", false
+	}
+	if version == currentLink || version == previousLink {
+		return "", false
+	}
+	return version, true
+}
+
+// selectVersions picks the versions to mirror from the ones a channel
+// has had, newest first.
+func (conf *config) selectVersions(versions []string) []string {
+	sorted := append([]string(nil), versions...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return versionfile.Compare(sorted[i], sorted[j]) > 0
+	})
+	var selected []string
+	for i, version := range sorted {
+		if i < conf.backfill {
+			selected = append(selected, version)
+			continue
+		}
+		for _, sel := range conf.versions {
+			if sel.Match(version) {
+				selected = append(selected, version)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// planVersion lists the files of the version, and sees which of them
+// are still missing.
+func (m *mirrorer) planVersion(ctx context.Context, v *VersionPlan) error {
+	links, err := m.list(ctx, v.URL)
+	if err != nil {
+		return err
+	}
+
+	v.Published, err = m.storage.Exists(ctx, v.dir())
+	if err != nil {
+		return err
+	}
+	v.local, err = m.storage.Stage(ctx, v.dir())
+	if err != nil {
+		return err
+	}
+	published, err := m.committed(ctx, v)
+	if err != nil {
+		return err
+	}
+	var names []string
+	seen := make(map[string]bool)
+	signed := make(map[string]bool)
+	// unsigned files can only be verified with DIGESTS files
+	hasDigests := false
+	// some file could not be looked at
+	unknown := false
+	for _, link := range links {
+		name, ok, err := staticFile(link)
+		if err != nil {
+			if err := m.errs.handle(err); err != nil {
+				return err
+			}
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if strings.HasSuffix(name, sigExt) {
+			name = name[:len(name)-len(sigExt)]
+			signed[name] = true
+			if strings.HasSuffix(name, digestsSuffix) {
+				hasDigests = true
+			}
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		unsigned := !signed[name]
+		if unsigned && (!m.conf.digested || !hasDigests) {
+			continue
+		}
+		if !m.conf.filter(name) {
+			m.obs.observe(&FileSkipped{Board: v.Board, Version: v.Version, Name: name, Reason: SkipFiltered})
+			continue
+		}
+		f := FilePlan{
+			Name:     name,
+			Unsigned: unsigned,
+			URL:      v.URL.ResolveReference(&url.URL{Path: name}),
+			Size:     -1,
+		}
+		// see if we have it already; files are considered immutable
+		fi, err := os.Stat(filepath.Join(v.local, name))
+		switch {
+		case err == nil:
+			f.Present = true
+			f.Size = fi.Size()
+		case !os.IsNotExist(err):
+			if err := m.errs.handle(err); err != nil {
+				return err
+			}
+			// cannot tell whether it is missing
+			unknown = true
+			continue
+		case published[name]:
+			f.Present = true
+		}
+		if f.Present {
+			m.obs.observe(&FileSkipped{Board: v.Board, Version: v.Version, Name: name, Reason: SkipPresent})
+		}
+		v.Files = append(v.Files, f)
+	}
+
+	v.listed = !unknown
+	if !m.conf.dryRun {
+		// downloading tells the sizes anyway
+		return nil
+	}
+	// find out the sizes of missing files
+	var wg sync.WaitGroup
+	for i := range v.Files {
+		if v.Files[i].Present {
+			continue
+		}
+		wg.Add(1)
+		go func(f *FilePlan) {
+			defer wg.Done()
+			// only informational; a server may well refuse to
+			// tell
+			if size, err := m.size(ctx, f.URL); err == nil {
+				f.Size = size
+			}
+		}(&v.Files[i])
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// sigExt is appended to the name of a file to get its signature.
+const sigExt = ".sig"
+
+// staticFile decides whether the link in a directory listing is to a
+// file in the same directory, and returns its name.
+func staticFile(link string) (name string, ok bool, err error) {
+	rel, err := url.Parse(link)
+	if err != nil {
+		return "", false, err
+	}
+	if rel.Scheme != "" || rel.Opaque != "" || rel.Host != "" || strings.HasPrefix(rel.Path, "/") {
+		// skip non-relative links
+		return "", false, nil
+	}
+	if strings.Contains(rel.Path, "/") {
+		// skip links to other directories
+		return "", false, nil
+	}
+	if strings.HasPrefix(rel.Path, ".") {
+		// skip links to hidden files (we use them for our own
+		// purposes) or other directories (the ".." case, without
+		// slash
+		return "", false, nil
+	}
+	if rel.RawQuery != "" || rel.Fragment != "" {
+		// skip things that don't look like links to static files
+		return "", false, nil
+	}
+	return rel.Path, true, nil
+}
@@ -0,0 +1,175 @@
+package oppositus_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"eagain.net/go/oppositus"
+	"eagain.net/go/oppositus/channels"
+	"golang.org/x/net/context"
+)
+
+func TestPrepare(t *testing.T) {
+	files := upstreamFiles(t)
+	srv := newUpstream(t, files)
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	opts := []oppositus.Option{
+		oppositus.WithBaseURL(srv.URL + "/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+	}
+	dryRun := append(opts[:len(opts):len(opts)], oppositus.WithDryRun(true))
+	plan, err := oppositus.Prepare(context.Background(), dst, dryRun...)
+	if err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	if len(plan.Channels) != 1 {
+		t.Fatalf("wrong channels: %+v", plan.Channels)
+	}
+	if g, e := plan.Channels[0].Version.Version, testVersion; g != e {
+		t.Errorf("wrong version: %q != %q", g, e)
+	}
+	if len(plan.Versions) != 1 {
+		t.Fatalf("wrong versions: %+v", plan.Versions)
+	}
+	v := plan.Versions[0]
+	if len(v.Files) != 1 {
+		t.Fatalf("wrong files: %+v", v.Files)
+	}
+	f := v.Files[0]
+	if g, e := f.Name, "version.txt"; g != e {
+		t.Errorf("wrong file name: %q != %q", g, e)
+	}
+	if f.Present {
+		t.Errorf("file should not be present yet")
+	}
+	size := int64(len(files["stable/"+testVersion+"/version.txt"]))
+	if g, e := f.Size, size; g != e {
+		t.Errorf("wrong size: %d != %d", g, e)
+	}
+	if g, e := plan.Bytes(), size; g != e {
+		t.Errorf("wrong total: %d != %d", g, e)
+	}
+	if _, err := os.Stat(dst + "/amd64-usr"); !os.IsNotExist(err) {
+		t.Errorf("prepare must not touch the destination: %v", err)
+	}
+	plan.Close()
+
+	// sizes are only asked for on dry runs
+	plan, err = oppositus.Prepare(context.Background(), dst, opts...)
+	if err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	if g, e := plan.Versions[0].Files[0].Size, int64(-1); g != e {
+		t.Errorf("wrong size: %d != %d", g, e)
+	}
+	if g, e := srv.count("HEAD", "/stable/"+testVersion+"/version.txt"), 1; g != e {
+		t.Errorf("wrong number of HEAD requests: %d != %d", g, e)
+	}
+	if _, err := plan.Execute(context.Background()); err != nil {
+		t.Fatalf("execute: %v", err)
+	}
+
+	plan, err = oppositus.Prepare(context.Background(), dst, opts...)
+	if err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	defer plan.Close()
+	if !plan.Versions[0].Files[0].Present {
+		t.Errorf("file should be present")
+	}
+	if g, e := plan.Bytes(), int64(0); g != e {
+		t.Errorf("wrong total: %d != %d", g, e)
+	}
+}
+
+func TestPrepareDryRun(t *testing.T) {
+	srv := newUpstream(t, upstreamFiles(t))
+	defer srv.Close()
+	parent := tempDir(t)
+	defer os.RemoveAll(parent)
+	dst := filepath.Join(parent, "mirror")
+
+	plan, err := oppositus.Prepare(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+		oppositus.WithDryRun(true),
+	)
+	if err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	defer plan.Close()
+	if g, e := len(plan.Versions), 1; g != e {
+		t.Fatalf("wrong versions: %d != %d", g, e)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("dry run created the destination: %v", err)
+	}
+	rep, err := plan.Execute(context.Background())
+	if err == nil {
+		t.Errorf("executed a dry run")
+	}
+	if rep == nil {
+		t.Errorf("no report")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("dry run created the destination: %v", err)
+	}
+}
+
+func TestPrepareSizeRefused(t *testing.T) {
+	srv := newUpstream(t, upstreamFiles(t))
+	defer srv.Close()
+	srv.failNext("HEAD", "/stable/"+testVersion+"/version.txt", 1)
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	plan, err := oppositus.Prepare(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+		oppositus.WithRetry(oppositus.RetryPolicy{Attempts: 1}),
+		oppositus.WithDryRun(true),
+	)
+	if err != nil {
+		t.Fatalf("prepare: %v", err)
+	}
+	defer plan.Close()
+	if g, e := plan.Versions[0].Files[0].Size, int64(-1); g != e {
+		t.Errorf("wrong size: %d != %d", g, e)
+	}
+}
+
+func TestPrepareVersionFailed(t *testing.T) {
+	srv := newUpstream(t, upstreamFiles(t))
+	defer srv.Close()
+	srv.failNext("GET", "/stable/"+testVersion+"/", 1)
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	var errs []error
+	rep, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+		oppositus.WithRetry(oppositus.RetryPolicy{Attempts: 1}),
+		oppositus.WithErrorHandler(func(err error) error {
+			errs = append(errs, err)
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	if g, e := len(errs), 1; g != e {
+		t.Errorf("wrong number of errors: %d != %d: %v", g, e, errs)
+	}
+	// left out of the plan, along with the channel
+	if len(rep.Versions) != 0 || len(rep.Channels) != 0 {
+		t.Errorf("failed version was mirrored: %+v", rep)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "amd64-usr")); !os.IsNotExist(err) {
+		t.Errorf("failed version was published: %v", err)
+	}
+}
@@ -0,0 +1,100 @@
+package oppositus
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// stagingSuffix marks the hidden directories versions are assembled
+// in, as "<board>/all/.<version>.staging".
+const stagingSuffix = ".staging"
+
+// WithPartialVersions publishes versions, and moves channels to them,
+// even if some of their files could not be mirrored. By default, a
+// version is only published once every selected file has been
+// verified, and an *IncompleteError is passed to the error handler
+// otherwise.
+func WithPartialVersions(enable bool) Option {
+	return func(conf *config) error {
+		conf.partial = enable
+		return nil
+	}
+}
+
+// IncompleteError means some files of a version could not be
+// mirrored, so the version was not published, and no channel was
+// moved to it. The files that were mirrored are kept, and the next
+// run only fetches the rest.
+type IncompleteError struct {
+	Board   string
+	Version string
+	Missing []string
+}
+
+func (e *IncompleteError) Error() string {
+	return fmt.Sprintf("incomplete version: %v/%v: missing %v", e.Board, e.Version, strings.Join(e.Missing, ", "))
+}
+
+// missing lists the files of the version that are not mirrored.
+// Unsigned files that no signed DIGESTS file covers are never
+// mirrored, and not counted.
+func (m *mirrorer) missing(ctx context.Context, v *VersionPlan, downloaded map[string]bool) ([]string, error) {
+	_, ds := m.verifiedDigests(ctx, v, downloaded)
+	committed, err := m.committed(ctx, v)
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, f := range v.Files {
+		if committed[f.Name] {
+			continue
+		}
+		_, err := os.Stat(filepath.Join(v.local, f.Name))
+		if err == nil {
+			continue
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if f.Unsigned {
+			listed := false
+			for _, d := range ds {
+				if _, ok := d[f.Name]; ok {
+					listed = true
+				}
+			}
+			if !listed {
+				continue
+			}
+		}
+		missing = append(missing, f.Name)
+	}
+	return missing, nil
+}
+
+// publish commits the staged files of a complete version to the
+// storage.
+func (m *mirrorer) publish(ctx context.Context, v *VersionPlan, downloaded map[string]bool) error {
+	if !v.listed {
+		// nothing would count as missing
+		return fmt.Errorf("not publishing %v/%v: its files could not be listed", v.Board, v.Version)
+	}
+	missing, err := m.missing(ctx, v, downloaded)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 && !m.conf.partial {
+		return &IncompleteError{Board: v.Board, Version: v.Version, Missing: missing}
+	}
+	if err := m.storage.Commit(ctx, v.dir()); err != nil {
+		return err
+	}
+	if !v.Published {
+		m.obs.observe(&VersionPublished{Board: v.Board, Version: v.Version})
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package oppositus_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"eagain.net/go/oppositus"
+	"eagain.net/go/oppositus/channels"
+	"eagain.net/go/oppositus/internal/s3test"
+	"eagain.net/go/oppositus/s3"
+	"golang.org/x/net/context"
+)
+
+func TestMirrorPartialVersions(t *testing.T) {
+	for _, partial := range []bool{false, true} {
+		files := upstreamFiles(t)
+		files["stable/"+testVersion+"/version.txt"] = []byte("junk\n")
+		srv := newUpstream(t, files)
+		dst := tempDir(t)
+
+		var errs []error
+		_, err := oppositus.Mirror(context.Background(), dst,
+			oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+			oppositus.WithChannels(channels.Stable),
+			oppositus.WithPartialVersions(partial),
+			oppositus.WithErrorHandler(func(err error) error {
+				errs = append(errs, err)
+				return nil
+			}),
+		)
+		if err != nil {
+			t.Fatalf("partial %v: mirror: %v", partial, err)
+		}
+		want := 2
+		if partial {
+			// not incomplete, just a bad signature
+			want = 1
+		}
+		if len(errs) != want {
+			t.Errorf("partial %v: wrong errors: %v", partial, errs)
+		}
+		board := filepath.Join(dst, "amd64-usr")
+		_, err = os.Stat(filepath.Join(board, "all", testVersion))
+		if got := err == nil; got != partial {
+			t.Errorf("partial %v: wrong publication: %v", partial, err)
+		}
+		_, err = os.Readlink(filepath.Join(board, "stable", "current"))
+		if got := err == nil; got != partial {
+			t.Errorf("partial %v: wrong channel update: %v", partial, err)
+		}
+		srv.Close()
+		os.RemoveAll(dst)
+	}
+}
+
+func TestMirrorPublishLater(t *testing.T) {
+	files := upstreamFiles(t)
+	good := files["stable/"+testVersion+"/version.txt"]
+	files["stable/"+testVersion+"/version.txt"] = []byte("junk\n")
+	srv := newUpstream(t, files)
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	mirror := func() {
+		_, err := oppositus.Mirror(context.Background(), dst,
+			oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+			oppositus.WithChannels(channels.Stable),
+			oppositus.WithErrorHandler(func(err error) error { return nil }),
+		)
+		if err != nil {
+			t.Fatalf("mirror: %v", err)
+		}
+	}
+	mirror()
+	board := filepath.Join(dst, "amd64-usr")
+	if _, err := os.Stat(filepath.Join(board, "all", "."+testVersion+".staging")); err != nil {
+		t.Fatalf("not staged: %v", err)
+	}
+
+	// upstream fixes the file
+	if err := ioutil.WriteFile(filepath.Join(srv.dir, "stable", testVersion, "version.txt"), good, 0644); err != nil {
+		t.Fatal(err)
+	}
+	mirror()
+	if _, err := os.Stat(filepath.Join(board, "all", testVersion, "version.txt")); err != nil {
+		t.Errorf("not published: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(board, "all", "."+testVersion+".staging")); !os.IsNotExist(err) {
+		t.Errorf("staging directory left behind: %v", err)
+	}
+	target, err := os.Readlink(filepath.Join(board, "stable", "current"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := target, "../all/"+testVersion; g != e {
+		t.Errorf("wrong current: %q != %q", g, e)
+	}
+}
+
+func TestMirrorPartialVersionsKeepDownloads(t *testing.T) {
+	files := upstreamFiles(t)
+	files["stable/"+testVersion+"/other.txt"] = files["stable/"+testVersion+"/version.txt"]
+	files["stable/"+testVersion+"/other.txt.sig"] = files["stable/"+testVersion+"/version.txt.sig"]
+	srv := newUpstream(t, files)
+	defer srv.Close()
+	srv.hangOn("GET", "/stable/"+testVersion+"/other.txt")
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	_, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+		oppositus.WithPartialVersions(true),
+		oppositus.WithFileTimeout(100*time.Millisecond),
+		oppositus.WithErrorHandler(func(err error) error { return nil }),
+	)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	all := filepath.Join(dst, "amd64-usr", "all")
+	fis, err := ioutil.ReadDir(filepath.Join(all, testVersion))
+	if err != nil {
+		t.Fatalf("not published: %v", err)
+	}
+	for _, fi := range fis {
+		if fi.Name()[0] == '.' {
+			t.Errorf("interrupted download published: %v", fi.Name())
+		}
+	}
+	// left to be resumed
+	if _, err := os.Stat(filepath.Join(all, "."+testVersion+".staging", ".other.txt.partial")); err != nil {
+		t.Errorf("interrupted download not kept: %v", err)
+	}
+}
+
+// flakyStorage fails listing a directory once.
+type flakyStorage struct {
+	oppositus.Storage
+
+	mu     sync.Mutex
+	failed bool
+}
+
+func (s *flakyStorage) List(ctx context.Context, dir string) ([]string, error) {
+	s.mu.Lock()
+	fail := !s.failed
+	s.failed = true
+	s.mu.Unlock()
+	if fail {
+		return nil, errors.New("listing failed")
+	}
+	return s.Storage.List(ctx, dir)
+}
+
+func TestMirrorListFailed(t *testing.T) {
+	srv := newUpstream(t, upstreamFiles(t))
+	defer srv.Close()
+	bucket := s3test.NewServer("mirror")
+	defer bucket.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	storage := &flakyStorage{Storage: &s3.Storage{
+		Endpoint:        bucket.URL,
+		Bucket:          bucket.Bucket,
+		Region:          s3test.Region,
+		AccessKeyID:     s3test.Credentials.AccessKeyID,
+		SecretAccessKey: s3test.Credentials.SecretAccessKey,
+		WorkDir:         dst,
+	}}
+	var errs []error
+	rep, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+		oppositus.WithStorage(storage),
+		oppositus.WithErrorHandler(func(err error) error {
+			errs = append(errs, err)
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	if len(errs) != 1 {
+		t.Errorf("wrong errors: %v", errs)
+	}
+	if len(rep.Channels) != 0 {
+		t.Errorf("channel was mirrored: %+v", rep.Channels)
+	}
+	if g := bucket.Keys(); len(g) != 0 {
+		t.Errorf("published without knowing what is missing: %q", g)
+	}
+}
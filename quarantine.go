@@ -0,0 +1,19 @@
+package oppositus
+
+import (
+	"eagain.net/go/oppositus/sig"
+)
+
+// WithQuarantine keeps files that fail signature verification under
+// dir, along with their signatures and a record of the responses, as
+// evidence. The files under dir take at most maxBytes; if zero,
+// sig.DefaultQuarantineMaxBytes. By default, such files are deleted.
+//
+// The path of the kept files is in the Quarantine field of the
+// *sig.SignatureError.
+func WithQuarantine(dir string, maxBytes int64) Option {
+	return func(conf *config) error {
+		conf.quarantine = &sig.Quarantine{Dir: dir, MaxBytes: maxBytes}
+		return nil
+	}
+}
@@ -0,0 +1,54 @@
+package oppositus_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"eagain.net/go/oppositus"
+	"eagain.net/go/oppositus/channels"
+	"eagain.net/go/oppositus/sig"
+	"golang.org/x/net/context"
+)
+
+func TestMirrorQuarantine(t *testing.T) {
+	files := upstreamFiles(t)
+	files["stable/"+testVersion+"/version.txt"] = []byte("evil\n")
+	srv := newUpstream(t, files)
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+	quarantine := filepath.Join(dst, ".quarantine")
+
+	var errs []error
+	_, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+		oppositus.WithQuarantine(quarantine, 0),
+		oppositus.WithErrorHandler(func(err error) error {
+			errs = append(errs, err)
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	serr, ok := assertNotPublished(t, dst, "amd64-usr", testVersion, errs).(*sig.SignatureError)
+	if !ok {
+		t.Fatalf("wrong error: %v", errs[0])
+	}
+	if filepath.Dir(serr.Quarantine) != quarantine {
+		t.Fatalf("not quarantined: %q", serr.Quarantine)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(serr.Quarantine, "version.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := string(got), "evil\n"; g != e {
+		t.Errorf("wrong file quarantined: %q != %q", g, e)
+	}
+	if _, err := os.Stat(filepath.Join(serr.Quarantine, sig.QuarantineRecordName)); err != nil {
+		t.Errorf("no record: %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package oppositus
+
+import (
+	"fmt"
+	"time"
+
+	"eagain.net/go/oppositus/internal/ratelimit"
+)
+
+// RateLimit limits the bandwidth used by downloads.
+type RateLimit struct {
+	// BytesPerSecond is the limit for all downloads together.
+	BytesPerSecond int64
+
+	// Windows, if set, are when the limit applies. At other times,
+	// downloads run at full speed.
+	Windows []TimeWindow
+}
+
+// TimeWindow is a recurring period of local time.
+type TimeWindow struct {
+	// Start and End are times of day, as durations since midnight.
+	// If End is not after Start, the window extends past midnight.
+	Start, End time.Duration
+
+	// Weekdays are the days the window starts on. If nil, it starts
+	// every day.
+	Weekdays []time.Weekday
+}
+
+// Contains reports whether t is within the window.
+func (w TimeWindow) Contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	sinceMidnight := t.Sub(midnight)
+	if w.End > w.Start {
+		return w.Start <= sinceMidnight && sinceMidnight < w.End && w.startsOn(t.Weekday())
+	}
+	// before End, the window started the previous day
+	if sinceMidnight < w.End {
+		return w.startsOn((t.Weekday() + 6) % 7)
+	}
+	return sinceMidnight >= w.Start && w.startsOn(t.Weekday())
+}
+
+func (w TimeWindow) startsOn(day time.Weekday) bool {
+	if w.Weekdays == nil {
+		return true
+	}
+	for _, d := range w.Weekdays {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// rate returns the limit in effect at the given time, or 0 if there
+// is none.
+func (l RateLimit) rate(now time.Time) int64 {
+	if l.Windows == nil {
+		return l.BytesPerSecond
+	}
+	for _, w := range l.Windows {
+		if w.Contains(now) {
+			return l.BytesPerSecond
+		}
+	}
+	return 0
+}
+
+// WithRateLimit limits the bandwidth used by downloads. The limit is
+// shared by all concurrent downloads. By default, there is no limit.
+func WithRateLimit(limit RateLimit) Option {
+	return func(conf *config) error {
+		if limit.BytesPerSecond <= 0 {
+			return fmt.Errorf("rate limit must be positive: %d", limit.BytesPerSecond)
+		}
+		const day = 24 * time.Hour
+		for _, w := range limit.Windows {
+			if w.Start < 0 || w.Start >= day || w.End < 0 || w.End > day {
+				return fmt.Errorf("time window must be within a day: %v-%v", w.Start, w.End)
+			}
+		}
+		conf.rateLimit = ratelimit.New(limit.rate)
+		return nil
+	}
+}
@@ -0,0 +1,76 @@
+package oppositus_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"eagain.net/go/oppositus"
+	"eagain.net/go/oppositus/channels"
+	"golang.org/x/net/context"
+)
+
+func TestTimeWindow(t *testing.T) {
+	officeHours := oppositus.TimeWindow{
+		Start:    8 * time.Hour,
+		End:      18 * time.Hour,
+		Weekdays: []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+	}
+	nights := oppositus.TimeWindow{
+		Start: 22 * time.Hour,
+		End:   6 * time.Hour,
+	}
+	fridayNights := oppositus.TimeWindow{
+		Start:    22 * time.Hour,
+		End:      6 * time.Hour,
+		Weekdays: []time.Weekday{time.Friday},
+	}
+	// 2019-06-07 is a Friday
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2019, 6, day, hour, min, 0, 0, time.Local)
+	}
+	tests := []struct {
+		window oppositus.TimeWindow
+		t      time.Time
+		want   bool
+	}{
+		{officeHours, at(7, 8, 0), true},
+		{officeHours, at(7, 17, 59), true},
+		{officeHours, at(7, 18, 0), false},
+		{officeHours, at(7, 7, 59), false},
+		{officeHours, at(8, 12, 0), false},
+		{nights, at(7, 23, 0), true},
+		{nights, at(7, 3, 0), true},
+		{nights, at(7, 12, 0), false},
+		{fridayNights, at(7, 23, 0), true},
+		{fridayNights, at(8, 3, 0), true},
+		{fridayNights, at(7, 3, 0), false},
+		{fridayNights, at(8, 23, 0), false},
+	}
+	for i, test := range tests {
+		if g, e := test.window.Contains(test.t), test.want; g != e {
+			t.Errorf("#%d: %v: %v != %v", i, test.t, g, e)
+		}
+	}
+}
+
+func TestMirrorRateLimit(t *testing.T) {
+	srv := newUpstream(t, upstreamFiles(t))
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	start := time.Now()
+	_, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+		oppositus.WithRateLimit(oppositus.RateLimit{BytesPerSecond: 1000}),
+	)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	// the file and its signature are 704 bytes
+	if d := time.Since(start); d < 500*time.Millisecond {
+		t.Errorf("mirroring was too fast: %v", d)
+	}
+}
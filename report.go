@@ -0,0 +1,331 @@
+package oppositus
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"eagain.net/go/oppositus/channels"
+)
+
+// Report summarizes what Execute did.
+type Report struct {
+	// Channels lists the channels that were mirrored, with the
+	// results for the version each is now at.
+	Channels []ChannelReport
+	// Versions lists every version that was mirrored, including
+	// older versions selected with WithVersions or WithBackfill.
+	Versions []VersionReport
+	Duration time.Duration
+}
+
+// ChannelReport tells what happened to a channel. The file results
+// are those of the version the channel was to be moved to; channels
+// at the same version share them.
+type ChannelReport struct {
+	Channel channels.Channel
+	// Previous is the version the channel was at before, or empty
+	// if it had not been mirrored before. It is the same as Version
+	// if the channel has not changed.
+	Previous string
+	// Status tells whether the channel is now at Version. If it is
+	// ChannelFailed, the channel is still at Previous.
+	Status ChannelStatus
+	VersionReport
+}
+
+// ChannelStatus tells whether a channel was moved to its version.
+type ChannelStatus int
+
+// Outcomes for a channel.
+const (
+	// ChannelFailed means the version could not be mirrored, or the
+	// channel could not be moved to it.
+	ChannelFailed ChannelStatus = iota
+	// ChannelUnchanged means the channel was already at the
+	// version.
+	ChannelUnchanged
+	// ChannelUpdated means the channel was moved to the version.
+	ChannelUpdated
+)
+
+func (s ChannelStatus) String() string {
+	switch s {
+	case ChannelFailed:
+		return "failed"
+	case ChannelUnchanged:
+		return "unchanged"
+	case ChannelUpdated:
+		return "updated"
+	}
+	return fmt.Sprintf("ChannelStatus(%d)", int(s))
+}
+
+// VersionReport tells what happened to the files of a version.
+type VersionReport struct {
+	Board   string
+	Version string
+	// Downloaded lists the files that were downloaded and verified,
+	// with their signatures or DIGESTS files.
+	Downloaded []string
+	// Skipped lists the files that had already been mirrored.
+	Skipped []string
+	// Failed lists the files that could not be mirrored.
+	Failed []FileError
+	// Bytes is how much of the files was downloaded by this run,
+	// not counting signatures, or the parts of resumed downloads
+	// fetched by earlier runs.
+	Bytes    int64
+	Duration time.Duration
+}
+
+// FileError tells why a file could not be mirrored.
+type FileError struct {
+	Name string
+	Err  error
+}
+
+type fileErrorJSON struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// MarshalJSON converts the error into a string.
+func (e FileError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fileErrorJSON{Name: e.Name, Error: e.Err.Error()})
+}
+
+type versionReportJSON struct {
+	Board      string      `json:"board"`
+	Version    string      `json:"version"`
+	Downloaded []string    `json:"downloaded"`
+	Skipped    []string    `json:"skipped"`
+	Failed     []FileError `json:"failed"`
+	Bytes      int64       `json:"bytes"`
+	Seconds    float64     `json:"seconds"`
+}
+
+func (r *VersionReport) toJSON() versionReportJSON {
+	return versionReportJSON{
+		Board:      r.Board,
+		Version:    r.Version,
+		Downloaded: nonNil(r.Downloaded),
+		Skipped:    nonNil(r.Skipped),
+		Failed:     r.Failed,
+		Bytes:      r.Bytes,
+		Seconds:    r.Duration.Seconds(),
+	}
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// MarshalJSON uses lowercase keys, and gives the duration in seconds.
+func (r VersionReport) MarshalJSON() ([]byte, error) {
+	j := r.toJSON()
+	if j.Failed == nil {
+		j.Failed = []FileError{}
+	}
+	return json.Marshal(j)
+}
+
+// MarshalJSON uses lowercase keys, and gives the duration in seconds.
+func (r ChannelReport) MarshalJSON() ([]byte, error) {
+	j := struct {
+		Channel  channels.Channel `json:"channel"`
+		Previous string           `json:"previous"`
+		Status   string           `json:"status"`
+		versionReportJSON
+	}{
+		Channel:           r.Channel,
+		Previous:          r.Previous,
+		Status:            r.Status.String(),
+		versionReportJSON: r.VersionReport.toJSON(),
+	}
+	if j.Failed == nil {
+		j.Failed = []FileError{}
+	}
+	return json.Marshal(j)
+}
+
+// MarshalJSON uses lowercase keys, and gives the duration in seconds.
+func (r Report) MarshalJSON() ([]byte, error) {
+	j := struct {
+		Channels []ChannelReport `json:"channels"`
+		Versions []VersionReport `json:"versions"`
+		Seconds  float64         `json:"seconds"`
+	}{
+		Channels: r.Channels,
+		Versions: r.Versions,
+		Seconds:  r.Duration.Seconds(),
+	}
+	if j.Channels == nil {
+		j.Channels = []ChannelReport{}
+	}
+	if j.Versions == nil {
+		j.Versions = []VersionReport{}
+	}
+	return json.Marshal(j)
+}
+
+// reporter builds a Report from events.
+type reporter struct {
+	mu    sync.Mutex
+	start time.Time
+	// keyed by board and version
+	versions map[string]*versionState
+	// keyed by index in the plan
+	previous map[int]string
+	updated  map[int]bool
+}
+
+type versionState struct {
+	report VersionReport
+	start  time.Time
+	// bytes transferred so far, per file
+	progress map[string]int64
+	// files whose download was started, and whether they have been
+	// counted as downloaded
+	started map[string]bool
+}
+
+// downloaded counts a file as downloaded, once.
+func (st *versionState) downloaded(name string) {
+	if counted, ok := st.started[name]; !ok || counted {
+		return
+	}
+	st.started[name] = true
+	st.report.Downloaded = append(st.report.Downloaded, name)
+	st.report.Bytes += st.progress[name]
+}
+
+func newReporter(p *Plan) *reporter {
+	r := &reporter{
+		start:    time.Now(),
+		versions: make(map[string]*versionState),
+		previous: make(map[int]string),
+		updated:  make(map[int]bool),
+	}
+	for _, v := range p.Versions {
+		st := &versionState{
+			report: VersionReport{
+				Board:   v.Board,
+				Version: v.Version,
+			},
+			progress: make(map[string]int64),
+			started:  make(map[string]bool),
+		}
+		for _, f := range v.Files {
+			if f.Present {
+				st.report.Skipped = append(st.report.Skipped, f.Name)
+			}
+		}
+		r.versions[v.Board+"/"+v.Version] = st
+	}
+	return r
+}
+
+// find returns the state of a version, or nil if it is not in the
+// plan.
+func (r *reporter) find(board, version string) *versionState {
+	return r.versions[board+"/"+version]
+}
+
+func (r *reporter) observe(ev Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch ev := ev.(type) {
+	case *VersionStarted:
+		if st := r.find(ev.Board, ev.Version); st != nil {
+			st.start = time.Now()
+		}
+	case *VersionCompleted:
+		if st := r.find(ev.Board, ev.Version); st != nil && !st.start.IsZero() {
+			st.report.Duration = time.Since(st.start)
+		}
+	case *DownloadProgress:
+		if st := r.find(ev.Board, ev.Version); st != nil {
+			st.progress[ev.Name] = ev.Transferred
+		}
+	case *DownloadStarted:
+		if st := r.find(ev.Board, ev.Version); st != nil {
+			st.started[ev.Name] = false
+		}
+	case *SignatureVerified:
+		if st := r.find(ev.Board, ev.Version); st != nil {
+			st.downloaded(ev.Name)
+		}
+	case *DigestVerified:
+		// also sent for files checked after their signature
+		if st := r.find(ev.Board, ev.Version); st != nil {
+			st.downloaded(ev.Name)
+		}
+	case *SignatureFailed:
+		if st := r.find(ev.Board, ev.Version); st != nil {
+			st.report.Failed = append(st.report.Failed, FileError{Name: ev.Name, Err: ev.Err})
+		}
+	case *DownloadFailed:
+		if st := r.find(ev.Board, ev.Version); st != nil {
+			st.report.Failed = append(st.report.Failed, FileError{Name: ev.Name, Err: ev.Err})
+		}
+	case *DigestFailed:
+		if st := r.find(ev.Board, ev.Version); st != nil {
+			for i, name := range st.report.Downloaded {
+				if name == ev.Name {
+					st.report.Downloaded = append(st.report.Downloaded[:i:i], st.report.Downloaded[i+1:]...)
+					st.report.Bytes -= st.progress[ev.Name]
+					break
+				}
+			}
+			st.report.Failed = append(st.report.Failed, FileError{Name: ev.Name, Err: ev.Err})
+		}
+	}
+}
+
+// setPrevious records what version the channel at index i of the plan
+// was at before.
+func (r *reporter) setPrevious(i int, version string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.previous[i] = version
+}
+
+// setUpdated records that the channel at index i of the plan is now
+// at its planned version.
+func (r *reporter) setUpdated(i int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.updated[i] = true
+}
+
+func (r *reporter) report(p *Plan) *Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rep := &Report{
+		Duration: time.Since(r.start),
+	}
+	for _, v := range p.Versions {
+		rep.Versions = append(rep.Versions, r.find(v.Board, v.Version).report)
+	}
+	for i, c := range p.Channels {
+		status := ChannelFailed
+		switch {
+		case r.previous[i] == c.Version.Version:
+			status = ChannelUnchanged
+		case r.updated[i]:
+			status = ChannelUpdated
+		}
+		rep.Channels = append(rep.Channels, ChannelReport{
+			Channel:       c.Channel,
+			Previous:      r.previous[i],
+			Status:        status,
+			VersionReport: r.find(c.Board, c.Version.Version).report,
+		})
+	}
+	return rep
+}
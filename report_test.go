@@ -0,0 +1,199 @@
+package oppositus_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"eagain.net/go/oppositus"
+	"eagain.net/go/oppositus/channels"
+	"golang.org/x/net/context"
+)
+
+func TestReport(t *testing.T) {
+	srv := newUpstream(t, upstreamFiles(t))
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	chanPath := filepath.Join(dst, "amd64-usr", "stable")
+	if err := os.MkdirAll(chanPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../all/800.0.0", filepath.Join(chanPath, "current")); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := []oppositus.Option{
+		oppositus.WithBaseURL(srv.URL + "/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+	}
+	rep, err := oppositus.Mirror(context.Background(), dst, opts...)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	if g, e := len(rep.Channels), 1; g != e {
+		t.Fatalf("wrong number of channels: %d != %d", g, e)
+	}
+	c := rep.Channels[0]
+	if g, e := c.Channel, channels.Stable; g != e {
+		t.Errorf("wrong channel: %v != %v", g, e)
+	}
+	if g, e := c.Version, testVersion; g != e {
+		t.Errorf("wrong version: %q != %q", g, e)
+	}
+	if g, e := c.Previous, "800.0.0"; g != e {
+		t.Errorf("wrong previous version: %q != %q", g, e)
+	}
+	if g, e := c.Status, oppositus.ChannelUpdated; g != e {
+		t.Errorf("wrong status: %v != %v", g, e)
+	}
+	if g, e := c.Downloaded, []string{"version.txt"}; !reflect.DeepEqual(g, e) {
+		t.Errorf("wrong downloads: %q != %q", g, e)
+	}
+	if len(c.Skipped) != 0 || len(c.Failed) != 0 {
+		t.Errorf("unexpected skips or failures: %q %v", c.Skipped, c.Failed)
+	}
+	if g, e := c.Bytes, int64(len(readTestdata(t, "version.txt"))); g != e {
+		t.Errorf("wrong byte count: %d != %d", g, e)
+	}
+	if g, e := rep.Versions, []oppositus.VersionReport{c.VersionReport}; !reflect.DeepEqual(g, e) {
+		t.Errorf("wrong versions: %+v != %+v", g, e)
+	}
+
+	// nothing to do the second time around
+	rep, err = oppositus.Mirror(context.Background(), dst, opts...)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	c = rep.Channels[0]
+	if g, e := c.Previous, testVersion; g != e {
+		t.Errorf("wrong previous version: %q != %q", g, e)
+	}
+	if g, e := c.Status, oppositus.ChannelUnchanged; g != e {
+		t.Errorf("wrong status: %v != %v", g, e)
+	}
+	if g, e := c.Skipped, []string{"version.txt"}; !reflect.DeepEqual(g, e) {
+		t.Errorf("wrong skips: %q != %q", g, e)
+	}
+	if len(c.Downloaded) != 0 || c.Bytes != 0 {
+		t.Errorf("unexpected downloads: %q, %d bytes", c.Downloaded, c.Bytes)
+	}
+
+	buf, err := json.Marshal(rep)
+	if err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	var j struct {
+		Channels []map[string]interface{} `json:"channels"`
+	}
+	if err := json.Unmarshal(buf, &j); err != nil {
+		t.Fatalf("json: %v", err)
+	}
+	want := map[string]interface{}{
+		"channel":    "stable",
+		"board":      "amd64-usr",
+		"version":    testVersion,
+		"previous":   testVersion,
+		"status":     "unchanged",
+		"downloaded": []interface{}{},
+		"skipped":    []interface{}{"version.txt"},
+		"failed":     []interface{}{},
+		"bytes":      0.0,
+	}
+	got := j.Channels[0]
+	delete(got, "seconds")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wrong json: %v != %v", got, want)
+	}
+}
+
+func TestReportBadSignature(t *testing.T) {
+	files := upstreamFiles(t)
+	files["stable/"+testVersion+"/version.txt"] = []byte("evil\n")
+	srv := newUpstream(t, files)
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	chanPath := filepath.Join(dst, "amd64-usr", "stable")
+	if err := os.MkdirAll(chanPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../all/800.0.0", filepath.Join(chanPath, "current")); err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+		oppositus.WithErrorHandler(func(err error) error { return nil }),
+	)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	// the channel stays where it was
+	if g, e := rep.Channels[0].Previous, "800.0.0"; g != e {
+		t.Errorf("wrong previous version: %q != %q", g, e)
+	}
+	if g, e := rep.Channels[0].Status, oppositus.ChannelFailed; g != e {
+		t.Errorf("wrong status: %v != %v", g, e)
+	}
+	failed := rep.Channels[0].Failed
+	if g, e := len(failed), 1; g != e {
+		t.Fatalf("wrong number of failures: %d != %d", g, e)
+	}
+	if g, e := failed[0].Name, "version.txt"; g != e {
+		t.Errorf("wrong failed file: %q != %q", g, e)
+	}
+	if failed[0].Err == nil {
+		t.Error("failure has no error")
+	}
+	if len(rep.Channels[0].Downloaded) != 0 {
+		t.Errorf("unexpected downloads: %q", rep.Channels[0].Downloaded)
+	}
+}
+
+func TestReportResumed(t *testing.T) {
+	srv := newUpstream(t, upstreamFiles(t))
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	// pretend an earlier run was interrupted
+	u := srv.URL + "/stable/" + testVersion + "/version.txt"
+	resp, err := http.Head(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	content := readTestdata(t, "version.txt")
+	staging := filepath.Join(dst, "amd64-usr", "all", "."+testVersion+".staging")
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(staging, ".version.txt.partial"), content[:10], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(staging, ".version.txt.partial.validator"), []byte(resp.Header.Get("Last-Modified")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+	)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	if g, e := rep.Versions[0].Downloaded, []string{"version.txt"}; !reflect.DeepEqual(g, e) {
+		t.Errorf("wrong downloads: %q != %q", g, e)
+	}
+	if g, e := rep.Versions[0].Bytes, int64(len(content)-10); g != e {
+		t.Errorf("wrong byte count: %d != %d", g, e)
+	}
+}
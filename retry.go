@@ -0,0 +1,151 @@
+package oppositus
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"eagain.net/go/oppositus/sig"
+	"golang.org/x/net/context"
+)
+
+// RetryPolicy decides how failed requests are retried. Only network
+// timeouts, temporary network errors, responses cut short, and the
+// HTTP statuses in Statuses are retried; certificate errors and the
+// like would only fail again. A file with a bad signature is never
+// downloaded again in the same run.
+type RetryPolicy struct {
+	// Attempts is how many times a request is made at most. Zero
+	// and one both mean no retries. Downloading a file and its
+	// signature counts as one request, and retrying it resumes
+	// where the previous attempt stopped.
+	Attempts int
+
+	// Backoff is how long to wait before the first retry. The wait
+	// doubles for every further retry, up to MaxBackoff if that is
+	// set.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Jitter shortens every wait by a random fraction of up to this
+	// much, so that parallel downloads do not retry in lockstep. It
+	// must be between 0 and 1.
+	Jitter float64
+
+	// Statuses are the HTTP response statuses that are retried. If
+	// nil, DefaultRetryStatuses is used.
+	Statuses []int
+}
+
+// DefaultRetryStatuses are the HTTP response statuses retried unless
+// RetryPolicy says otherwise.
+var DefaultRetryStatuses = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// WithRetry sets how failed requests for version.txt files, directory
+// listings and downloads are retried. By default, they are not.
+func WithRetry(policy RetryPolicy) Option {
+	return func(conf *config) error {
+		if policy.Attempts < 0 {
+			return fmt.Errorf("retry attempts cannot be negative: %d", policy.Attempts)
+		}
+		if policy.Backoff < 0 || policy.MaxBackoff < 0 {
+			return fmt.Errorf("retry backoff cannot be negative: %v", policy.Backoff)
+		}
+		if policy.Jitter < 0 || policy.Jitter > 1 {
+			return fmt.Errorf("retry jitter must be between 0 and 1: %v", policy.Jitter)
+		}
+		conf.retry = policy
+		return nil
+	}
+}
+
+// retryable decides whether the error of a failed attempt is worth
+// trying again.
+func (p *RetryPolicy) retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		// the error is likely just a symptom of the cancellation
+		return false
+	}
+	switch err := err.(type) {
+	case *sig.SignatureError:
+		return false
+	case *sig.StatusError:
+		statuses := p.Statuses
+		if statuses == nil {
+			statuses = DefaultRetryStatuses
+		}
+		for _, code := range statuses {
+			if err.StatusCode == code {
+				return true
+			}
+		}
+		return false
+	case *sig.StallError:
+		return true
+	case *url.Error:
+		// certificate and pin failures, bad schemes and the like
+		// would only fail again
+		return retryableNet(err.Err)
+	}
+	return retryableNet(err)
+}
+
+// retryableNet decides whether a network error might go away.
+func retryableNet(err error) bool {
+	if err, ok := err.(net.Error); ok {
+		return err.Timeout() || err.Temporary()
+	}
+	return err == io.ErrUnexpectedEOF
+}
+
+// backoff returns how long to wait after the given failed attempt,
+// counting from 1.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt; i++ {
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff || d > math.MaxInt64/2 {
+			break
+		}
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	d -= time.Duration(p.Jitter * rand.Float64() * float64(d))
+	return d
+}
+
+// retry calls fn until it succeeds, fails with an error that is not
+// worth retrying, or the retry policy runs out of attempts. It
+// returns the last error. The URL is only used to tell the observer
+// what is being retried.
+func (m *mirrorer) retry(ctx context.Context, u *url.URL, fn func() error) error {
+	policy := &m.conf.retry
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= policy.Attempts || !policy.retryable(ctx, err) {
+			return err
+		}
+		delay := policy.backoff(attempt)
+		m.obs.observe(&Retrying{URL: u, Attempt: attempt, Delay: delay, Err: err})
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
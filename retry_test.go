@@ -0,0 +1,158 @@
+package oppositus_test
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"eagain.net/go/oppositus"
+	"eagain.net/go/oppositus/channels"
+	"eagain.net/go/oppositus/internal/httpclient"
+	"golang.org/x/net/context"
+)
+
+func TestMirrorRetry(t *testing.T) {
+	tests := []struct {
+		attempts int
+		ok       bool
+	}{
+		{attempts: 0, ok: false},
+		{attempts: 2, ok: false},
+		{attempts: 3, ok: true},
+	}
+	for i, test := range tests {
+		srv := newUpstream(t, upstreamFiles(t))
+		dst := tempDir(t)
+
+		srv.failNext("GET", "/stable/current/version.txt", 2)
+		srv.failNext("GET", "/stable/"+testVersion+"/", 2)
+		// a download attempt fetches both, so these take two
+		// retries together
+		srv.failNext("GET", "/stable/"+testVersion+"/version.txt.sig", 1)
+		srv.failNext("GET", "/stable/"+testVersion+"/version.txt", 1)
+		var retries int
+		_, err := oppositus.Mirror(context.Background(), dst,
+			oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+			oppositus.WithChannels(channels.Stable),
+			oppositus.WithRetry(oppositus.RetryPolicy{
+				Attempts: test.attempts,
+				Backoff:  time.Millisecond,
+				Jitter:   0.5,
+			}),
+			oppositus.WithObserver(func(ev oppositus.Event) {
+				if _, ok := ev.(*oppositus.Retrying); ok {
+					retries++
+				}
+			}),
+		)
+		_, statErr := os.Stat(filepath.Join(dst, "amd64-usr", "all", testVersion, "version.txt"))
+		switch {
+		case test.ok && err != nil:
+			t.Errorf("#%d: mirror: %v", i, err)
+		case test.ok && statErr != nil:
+			t.Errorf("#%d: not mirrored: %v", i, statErr)
+		case !test.ok && err == nil:
+			t.Errorf("#%d: expected an error", i)
+		}
+		if test.ok {
+			if g, e := retries, 6; g != e {
+				t.Errorf("#%d: wrong number of retries: %d != %d", i, g, e)
+			}
+		}
+		srv.Close()
+		os.RemoveAll(dst)
+	}
+}
+
+func TestMirrorRetryBadSignature(t *testing.T) {
+	files := upstreamFiles(t)
+	files["stable/"+testVersion+"/version.txt"] = []byte("evil\n")
+	srv := newUpstream(t, files)
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	_, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+		oppositus.WithRetry(oppositus.RetryPolicy{Attempts: 5}),
+		oppositus.WithErrorHandler(func(err error) error { return nil }),
+	)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	if g, e := srv.count("GET", "/stable/"+testVersion+"/version.txt"), 1; g != e {
+		t.Errorf("bad signature was retried: %d requests", g)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "amd64-usr", "all", testVersion, "version.txt")); !os.IsNotExist(err) {
+		t.Errorf("file with bad signature was kept: %v", err)
+	}
+}
+
+func TestWithRetryBadJitter(t *testing.T) {
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	_, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithRetry(oppositus.RetryPolicy{Attempts: 3, Jitter: 2}),
+	)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if g, e := err.Error(), "retry jitter must be between 0 and 1: 2"; g != e {
+		t.Errorf("wrong error: %q != %q", g, e)
+	}
+}
+
+func TestMirrorRetryPinMismatch(t *testing.T) {
+	var requests int
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+	}))
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+	ca := filepath.Join(dst, "ca.pem")
+	if err := ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client, err := httpclient.New(httpclient.Options{
+		Upstreams: []httpclient.Upstream{{
+			URL: srv.URL,
+			TLS: httpclient.TLS{
+				CAFile:     ca,
+				PinnedSPKI: []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var retries int
+	_, err = oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+		oppositus.WithHTTPClient(client),
+		oppositus.WithRetry(oppositus.RetryPolicy{Attempts: 3, Backoff: time.Millisecond}),
+		oppositus.WithObserver(func(ev oppositus.Event) {
+			if _, ok := ev.(*oppositus.Retrying); ok {
+				retries++
+			}
+		}),
+	)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if retries != 0 {
+		t.Errorf("pin mismatch retried %d times: %v", retries, err)
+	}
+	if requests != 0 {
+		t.Errorf("requests reached the server: %d", requests)
+	}
+}
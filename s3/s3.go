@@ -0,0 +1,323 @@
+// Package s3 keeps a mirror in an S3-compatible object store, such as
+// Amazon S3 or MinIO. Use it with oppositus.WithStorage.
+//
+// Object stores have no symlinks, so channel pointers like
+// "amd64-usr/stable/current" are small objects holding the target,
+// like "../all/899.15.0". They also redirect to the version directory
+// when the bucket is served as a static website.
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"eagain.net/go/oppositus/internal/sigv4"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// DefaultRegion is the region requests are signed for, unless
+// Storage says otherwise.
+const DefaultRegion = "us-east-1"
+
+// Error is an error response from the object store.
+type Error struct {
+	Method     string
+	Key        string
+	StatusCode int
+	// Code is the S3 error code, like "NoSuchKey", if the response
+	// had one.
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: %s %s: %d %s", e.Method, e.Key, e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("s3: %s %s: %s: %s", e.Method, e.Key, e.Code, e.Message)
+}
+
+// Storage keeps the mirror in a bucket. It implements
+// oppositus.Storage.
+type Storage struct {
+	// Endpoint is the URL of the service, like
+	// "https://s3.eu-west-1.amazonaws.com" or
+	// "http://localhost:9000". Buckets are addressed in the path.
+	Endpoint string
+	Bucket   string
+	// Prefix is prepended to every key, like "coreos/".
+	Prefix string
+	// Region is what requests are signed for. If empty,
+	// DefaultRegion is used.
+	Region string
+
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is only needed with temporary credentials.
+	SessionToken string
+
+	// WorkDir is the local directory files are staged in before
+	// they are uploaded.
+	WorkDir string
+
+	// Client is used for the requests. If nil, http.DefaultClient
+	// is used.
+	Client *http.Client
+}
+
+func (s *Storage) key(p string) string {
+	return path.Join(s.Prefix, p)
+}
+
+func (s *Storage) region() string {
+	if s.Region == "" {
+		return DefaultRegion
+	}
+	return s.Region
+}
+
+// do makes a signed request for key, with query parameters q. A body
+// of nil means none, and a body of a *os.File is sent unsigned.
+func (s *Storage) do(ctx context.Context, method, key string, q url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/") + "/" + s.Bucket + "/")
+	if err != nil {
+		return nil, err
+	}
+	u.Path += key
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	payload := sigv4.EmptyPayload
+	switch b := body.(type) {
+	case nil:
+	case *bytes.Reader:
+		buf := make([]byte, b.Len())
+		if _, err := b.ReadAt(buf, 0); err != nil && err != io.EOF {
+			return nil, err
+		}
+		payload = sigv4.PayloadHash(buf)
+	default:
+		payload = sigv4.UnsignedPayload
+		req.ContentLength = size
+	}
+	creds := sigv4.Credentials{
+		AccessKeyID:     s.AccessKeyID,
+		SecretAccessKey: s.SecretAccessKey,
+		SessionToken:    s.SessionToken,
+	}
+	sigv4.Sign(req, creds, s.region(), "s3", time.Now(), payload)
+	resp, err := ctxhttp.Do(ctx, s.Client, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		e := &Error{Method: method, Key: key, StatusCode: resp.StatusCode}
+		var x struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		if buf, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024)); err == nil && xml.Unmarshal(buf, &x) == nil {
+			e.Code = x.Code
+			e.Message = x.Message
+		}
+		return nil, e
+	}
+	return resp, nil
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// Stage returns the directory under WorkDir for dir.
+func (s *Storage) Stage(ctx context.Context, dir string) (string, error) {
+	return filepath.Join(s.WorkDir, filepath.FromSlash(dir)), nil
+}
+
+// Commit uploads the files staged for dir, and removes them locally.
+// Hidden files, like interrupted downloads, are kept for the next
+// run.
+func (s *Storage) Commit(ctx context.Context, dir string) error {
+	local, err := s.Stage(ctx, dir)
+	if err != nil {
+		return err
+	}
+	fis, err := ioutil.ReadDir(local)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		p := filepath.Join(local, fi.Name())
+		if err := s.upload(ctx, path.Join(dir, fi.Name()), p, fi.Size()); err != nil {
+			return err
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+	}
+	// fails if there were hidden files
+	_ = os.Remove(local)
+	return nil
+}
+
+func (s *Storage) upload(ctx context.Context, p, local string, size int64) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	resp, err := s.do(ctx, "PUT", s.key(p), nil, header, f, size)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Exists reports whether p is an object, or a prefix of objects.
+func (s *Storage) Exists(ctx context.Context, p string) (bool, error) {
+	resp, err := s.do(ctx, "HEAD", s.key(p), nil, nil, nil, 0)
+	if err == nil {
+		return true, resp.Body.Close()
+	}
+	if !isNotFound(err) {
+		return false, err
+	}
+	keys, _, err := s.list(ctx, s.key(p)+"/", "", 1)
+	if err != nil {
+		return false, err
+	}
+	return len(keys) > 0, nil
+}
+
+// List returns the names of the objects directly under dir.
+func (s *Storage) List(ctx context.Context, dir string) ([]string, error) {
+	prefix := s.key(dir) + "/"
+	var names []string
+	token := ""
+	for {
+		keys, next, err := s.list(ctx, prefix, token, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			names = append(names, strings.TrimPrefix(key, prefix))
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// list makes one ListObjectsV2 request for the keys directly under
+// prefix, returning the continuation token if there are more.
+func (s *Storage) list(ctx context.Context, prefix, token string, max int) (keys []string, next string, err error) {
+	q := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+		"delimiter": {"/"},
+	}
+	if token != "" {
+		q.Set("continuation-token", token)
+	}
+	if max > 0 {
+		q.Set("max-keys", fmt.Sprint(max))
+	}
+	resp, err := s.do(ctx, "GET", "", q, nil, nil, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		IsTruncated           bool   `xml:"IsTruncated"`
+		NextContinuationToken string `xml:"NextContinuationToken"`
+		Contents              []struct {
+			Key string `xml:"Key"`
+		} `xml:"Contents"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, "", fmt.Errorf("s3: bad listing of %s: %v", prefix, err)
+	}
+	for _, c := range res.Contents {
+		keys = append(keys, c.Key)
+	}
+	if res.IsTruncated {
+		next = res.NextContinuationToken
+	}
+	return keys, next, nil
+}
+
+// Open reads the object p. If there is no such object, the error
+// satisfies os.IsNotExist.
+func (s *Storage) Open(ctx context.Context, p string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, "GET", s.key(p), nil, nil, nil, 0)
+	if isNotFound(err) {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// maxPointerSize is the most read of a pointer object.
+const maxPointerSize = 4096
+
+// Pointer returns the target stored in the pointer object name.
+func (s *Storage) Pointer(ctx context.Context, name string) (string, error) {
+	r, err := s.Open(ctx, name)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	buf, err := ioutil.ReadAll(io.LimitReader(r, maxPointerSize))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
+
+// SetPointer stores target in the pointer object name, which also
+// redirects to the target directory.
+func (s *Storage) SetPointer(ctx context.Context, name, target string) error {
+	header := http.Header{
+		"Content-Type":                    {"text/plain; charset=utf-8"},
+		"X-Amz-Website-Redirect-Location": {"/" + s.key(path.Join(path.Dir(name), target)) + "/"},
+	}
+	resp, err := s.do(ctx, "PUT", s.key(name), nil, header, bytes.NewReader([]byte(target+"\n")), 0)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,185 @@
+package s3_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"eagain.net/go/oppositus"
+	"eagain.net/go/oppositus/internal/s3test"
+	"eagain.net/go/oppositus/s3"
+	"golang.org/x/net/context"
+)
+
+var _ oppositus.Storage = (*s3.Storage)(nil)
+
+func newStorage(t testing.TB, srv *s3test.Server) *s3.Storage {
+	dir, err := ioutil.TempDir("", "oppositus-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &s3.Storage{
+		Endpoint:        srv.URL,
+		Bucket:          srv.Bucket,
+		Prefix:          "coreos",
+		Region:          s3test.Region,
+		AccessKeyID:     s3test.Credentials.AccessKeyID,
+		SecretAccessKey: s3test.Credentials.SecretAccessKey,
+		WorkDir:         dir,
+	}
+}
+
+func TestCommit(t *testing.T) {
+	srv := s3test.NewServer("mirror")
+	defer srv.Close()
+	s := newStorage(t, srv)
+	defer os.RemoveAll(s.WorkDir)
+	ctx := context.Background()
+
+	dir := "amd64-usr/all/1.0.0"
+	local, err := s.Stage(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(local, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", ".b.partial"} {
+		if err := ioutil.WriteFile(filepath.Join(local, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, err := s.Exists(ctx, dir); err != nil || ok {
+		t.Fatalf("exists before commit: %v %v", ok, err)
+	}
+	if err := s.Commit(ctx, dir); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+
+	if g, e := srv.Keys(), []string{"coreos/amd64-usr/all/1.0.0/a", "coreos/amd64-usr/all/1.0.0/b"}; !reflect.DeepEqual(g, e) {
+		t.Errorf("wrong keys: %q != %q", g, e)
+	}
+	if ok, err := s.Exists(ctx, dir); err != nil || !ok {
+		t.Errorf("not found after commit: %v %v", ok, err)
+	}
+	if _, err := os.Stat(filepath.Join(local, "a")); !os.IsNotExist(err) {
+		t.Errorf("uploaded file still staged: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(local, ".b.partial")); err != nil {
+		t.Errorf("hidden file removed: %v", err)
+	}
+
+	r, err := s.Open(ctx, dir+"/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := string(buf), "b"; g != e {
+		t.Errorf("wrong content: %q != %q", g, e)
+	}
+	if _, err := s.Open(ctx, dir+"/c"); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error: %v", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	srv := s3test.NewServer("mirror")
+	defer srv.Close()
+	srv.PageSize = 2
+	s := newStorage(t, srv)
+	defer os.RemoveAll(s.WorkDir)
+	ctx := context.Background()
+
+	dir := "amd64-usr/all/1.0.0"
+	local, err := s.Stage(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(local, 0755); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"a", "b", "c", "d", "e"}
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(local, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Commit(ctx, dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetPointer(ctx, "amd64-usr/all/1.0.0/sub", "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.List(ctx, dir)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if e := append(names, "sub"); !reflect.DeepEqual(got, e) {
+		t.Errorf("wrong list: %q != %q", got, e)
+	}
+	got, err = s.List(ctx, "amd64-usr/all/2.0.0")
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("expected empty list: %q", got)
+	}
+}
+
+func TestPointer(t *testing.T) {
+	srv := s3test.NewServer("mirror")
+	defer srv.Close()
+	s := newStorage(t, srv)
+	defer os.RemoveAll(s.WorkDir)
+	ctx := context.Background()
+
+	name := "amd64-usr/stable/current"
+	target, err := s.Pointer(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "" {
+		t.Errorf("expected no pointer: %q", target)
+	}
+	if err := s.SetPointer(ctx, name, "../all/1.0.0"); err != nil {
+		t.Fatalf("set pointer: %v", err)
+	}
+	target, err = s.Pointer(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := target, "../all/1.0.0"; g != e {
+		t.Errorf("wrong pointer: %q != %q", g, e)
+	}
+	obj, ok := srv.Object("coreos/" + name)
+	if !ok {
+		t.Fatal("pointer not stored")
+	}
+	if g, e := obj.Header.Get("X-Amz-Website-Redirect-Location"), "/coreos/amd64-usr/all/1.0.0/"; g != e {
+		t.Errorf("wrong redirect: %q != %q", g, e)
+	}
+}
+
+func TestBadCredentials(t *testing.T) {
+	srv := s3test.NewServer("mirror")
+	defer srv.Close()
+	s := newStorage(t, srv)
+	defer os.RemoveAll(s.WorkDir)
+	s.SecretAccessKey = "wrong"
+
+	err := s.SetPointer(context.Background(), "amd64-usr/stable/current", "../all/1.0.0")
+	e, ok := err.(*s3.Error)
+	if !ok {
+		t.Fatalf("expected s3 error: %T %v", err, err)
+	}
+	if g, w := e.Code, "SignatureDoesNotMatch"; g != w {
+		t.Errorf("wrong code: %q != %q", g, w)
+	}
+}
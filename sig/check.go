@@ -14,7 +14,7 @@ import (
 
 //go:generate go run github.com/tv42/becky coreosKey.asc
 
-func asc(a asset) openpgp.KeyRing {
+func asc(a asset) openpgp.EntityList {
 	keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(a.Content))
 	if err != nil {
 		panic(fmt.Errorf("invalid format PGP keyring in asset %v: %v", a.Name, err))
@@ -23,10 +23,8 @@ func asc(a asset) openpgp.KeyRing {
 }
 
 // Check ensures that signed has been signed with the CoreOS Image
-// Signing Key.
+// Signing Key. It is the same as Verifier.Check with a zero Verifier.
 func Check(signed io.Reader, signature io.Reader) error {
-	if _, err := openpgp.CheckDetachedSignature(coreosKey, signed, signature); err != nil {
-		return err
-	}
-	return nil
+	var v Verifier
+	return v.Check(signed, signature)
 }
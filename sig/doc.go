@@ -1,3 +1,4 @@
-// Package sig checks signatures against the CoreOS Image Signing Key.
-// See https://coreos.com/security/image-signing-key/ for more.
+// Package sig checks signatures against the CoreOS Image Signing Key,
+// or other keys a Verifier trusts. See
+// https://coreos.com/security/image-signing-key/ for more.
 package sig
@@ -1,25 +1,229 @@
 package sig
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"time"
 
+	"eagain.net/go/oppositus/source"
 	"golang.org/x/net/context"
-	"golang.org/x/net/context/ctxhttp"
 )
 
+// SignatureError means a downloaded file did not have a good
+// signature, and was discarded.
+type SignatureError struct {
+	URL *url.URL
+	Err error
+	// Quarantine is the directory the file was kept in, if the
+	// Downloader has a Quarantine.
+	Quarantine string
+}
+
+func (e *SignatureError) Error() string {
+	if e.Quarantine != "" {
+		return fmt.Sprintf("bad signature: %v: %v (quarantined in %v)", e.URL, e.Err, e.Quarantine)
+	}
+	return fmt.Sprintf("bad signature: %v: %v", e.URL, e.Err)
+}
+
+// StatusError means the server responded to a request with an
+// unexpected status.
+type StatusError = source.StatusError
+
+// Downloader downloads signed files. The zero value is ready to use.
+type Downloader struct {
+	// Client is used for the requests. If nil, http.DefaultClient
+	// is used. It is ignored if Source is set.
+	Client *http.Client
+
+	// Source, if set, is where files are fetched from, instead of
+	// with HTTP requests made by Client.
+	Source source.Source
+
+	// RateLimit, if set, limits how fast response bodies are read.
+	RateLimit RateLimiter
+
+	// IdleTimeout, if set, aborts the download with a *StallError
+	// if no data arrives for this long. Time spent waiting for the
+	// rate limit does not count.
+	IdleTimeout time.Duration
+
+	// Progress, if set, is called as the file is being downloaded,
+	// with the number of bytes so far and the total size, or -1 if
+	// unknown. It is called at most once a second, and once more
+	// when the download is complete. Resumed downloads start from
+	// where they left off.
+	Progress func(n, total int64)
+
+	// Started, if set, is called every time fetching the file
+	// begins, with the number of bytes already downloaded that are
+	// resumed from, or zero.
+	Started func(offset int64)
+
+	// Quarantine, if set, keeps the files that fail signature
+	// verification, instead of deleting them.
+	Quarantine *Quarantine
+
+	// Verifier, if set, decides what signatures are good. If nil,
+	// only the CoreOS Image Signing Key is trusted.
+	Verifier *Verifier
+
+	// watch detects stalls during one call of Download
+	watch *watchdog
+}
+
+// RateLimiter limits bandwidth. It may be shared by many Downloaders.
+// The interface is satisfied by *rate.Limiter from
+// golang.org/x/time/rate, if its burst is at least maxLimitedRead.
+type RateLimiter interface {
+	// WaitN waits until n more bytes may be read.
+	WaitN(ctx context.Context, n int) error
+}
+
+// maxLimitedRead is the most read at once when rate limited, to keep
+// the waits short. It must not exceed the burst size of the limiter.
+const maxLimitedRead = 16 * 1024
+
+// limitedReader waits for the rate limiter after every read. The
+// watchdog is paused while waiting.
+type limitedReader struct {
+	ctx   context.Context
+	r     io.Reader
+	limit RateLimiter
+	watch *watchdog
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > maxLimitedRead {
+		p = p[:maxLimitedRead]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.watch.pause()
+		werr := r.limit.WaitN(r.ctx, n)
+		r.watch.kick()
+		if werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (d *Downloader) source() source.Source {
+	if d.Source != nil {
+		return d.Source
+	}
+	return &source.HTTP{Client: d.Client}
+}
+
+// body returns the reader for the content of a file, obeying the rate
+// limit and detecting stalls.
+func (d *Downloader) body(ctx context.Context, f *source.File) io.Reader {
+	var r io.Reader = f.Body
+	if d.watch != nil {
+		// headers count as data arriving
+		d.watch.kick()
+		r = &kickReader{r: r, w: d.watch}
+	}
+	if d.RateLimit != nil {
+		r = &limitedReader{ctx: ctx, r: r, limit: d.RateLimit, watch: d.watch}
+	}
+	return r
+}
+
 // Download fetches the URL and the corresponding *.sig signature, and
 // creates files under dst with matching basenames if the signature is
-// good.
+// good. It is the same as Downloader.Download with a zero Downloader.
 func Download(ctx context.Context, dst string, u *url.URL) error {
+	var d Downloader
+	return d.Download(ctx, dst, u)
+}
+
+// Download fetches the URL and the corresponding *.sig signature, and
+// creates files under dst with matching basenames if the signature is
+// good. If the signature is bad, the error is a *SignatureError; if
+// the server responds with an error status, it is a *StatusError.
+//
+// An interrupted download is kept in dst under a hidden name, and
+// resumed by the next call, if the source supports it; HTTP servers
+// need to support range requests.
+// The signature is always checked over the whole content.
+func (d *Downloader) Download(ctx context.Context, dst string, u *url.URL) error {
+	return d.watched(ctx, u, func(ctx context.Context, d *Downloader) error {
+		return d.download(ctx, dst, u)
+	})
+}
+
+// DownloadVerified fetches the URL, and creates a file under dst with
+// a matching basename if verify accepts the content. It is for files
+// that are not signed themselves, but vouched for by something that
+// is. If verify returns an error, the download is discarded, and the
+// error is returned as is.
+//
+// Interrupted downloads are resumed like with Download.
+func (d *Downloader) DownloadVerified(ctx context.Context, dst string, u *url.URL, verify func(r io.Reader) error) error {
+	return d.watched(ctx, u, func(ctx context.Context, d *Downloader) error {
+		return d.downloadVerified(ctx, dst, u, verify)
+	})
+}
+
+// watched calls fn with a copy of the Downloader that detects stalls,
+// if IdleTimeout is set.
+func (d *Downloader) watched(ctx context.Context, u *url.URL, fn func(ctx context.Context, d *Downloader) error) error {
+	if d.IdleTimeout <= 0 {
+		return fn(ctx, d)
+	}
+	dd := *d
+	ctx, dd.watch = newWatchdog(ctx, d.IdleTimeout)
+	defer dd.watch.stop()
+	err := fn(ctx, &dd)
+	if err != nil && dd.watch.stalled() {
+		return &StallError{URL: u, Timeout: d.IdleTimeout}
+	}
+	return err
+}
+
+func (d *Downloader) downloadVerified(ctx context.Context, dst string, u *url.URL, verify func(r io.Reader) error) error {
+	p := partial{
+		path:      path.Join(dst, "."+path.Base(u.Path)+".partial"),
+		validator: path.Join(dst, "."+path.Base(u.Path)+".partial.validator"),
+	}
+	f, err := p.fetch(ctx, d, u)
+	if err != nil {
+		return err
+	}
+	d.watch.pause()
+	err = verify(f)
+	if cerr := f.Close(); err == nil && cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		// not worth resuming
+		p.remove()
+		return err
+	}
+	if err := os.Rename(p.path, path.Join(dst, path.Base(u.Path))); err != nil {
+		return err
+	}
+	if err := os.Remove(p.validator); err != nil && !os.IsNotExist(err) {
+		log.Printf("cannot clean up temp file: %v", err)
+	}
+	return nil
+}
+
+func (d *Downloader) download(ctx context.Context, dst string, u *url.URL) error {
 	sigURL := new(url.URL)
 	*sigURL = *u
 	sigURL.Path += ".sig"
 
+	// fetch the small signature first, no point downloading the
+	// main file if that fails
 	sigFile, err := ioutil.TempFile(dst, "."+path.Base(sigURL.Path)+".tmp.")
 	if err != nil {
 		return err
@@ -34,36 +238,60 @@ func Download(ctx context.Context, dst string, u *url.URL) error {
 			}
 		}
 	}()
-	sigResp, err := ctxhttp.Get(ctx, nil, sigURL.String())
+	sigSrc, err := d.source().Open(ctx, sigURL, 0, "")
 	if err != nil {
 		return err
 	}
-	defer sigResp.Body.Close()
-	signature := io.TeeReader(sigResp.Body, sigFile)
+	defer sigSrc.Body.Close()
+	if _, err := io.Copy(sigFile, d.body(ctx, sigSrc)); err != nil {
+		return err
+	}
+	if _, err := sigFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
 
-	mainFile, err := ioutil.TempFile(dst, "."+path.Base(u.Path)+".tmp.")
+	p := partial{
+		path:      path.Join(dst, "."+path.Base(u.Path)+".partial"),
+		validator: path.Join(dst, "."+path.Base(u.Path)+".partial.validator"),
+	}
+	mainFile, err := p.fetch(ctx, d, u)
 	if err != nil {
 		return err
 	}
+	// checking a big file takes a while
+	d.watch.pause()
 	defer func() {
 		if mainFile != nil {
-			if err := os.Remove(mainFile.Name()); err != nil {
-				log.Printf("cannot clean up temp file: %v", err)
-			}
 			if err := mainFile.Close(); err != nil {
 				log.Printf("cannot close temp file: %v", err)
 			}
 		}
 	}()
-	mainResp, err := ctxhttp.Get(ctx, nil, u.String())
-	if err != nil {
-		return err
-	}
-	defer mainResp.Body.Close()
-	signed := io.TeeReader(mainResp.Body, mainFile)
 
-	if err := Check(signed, signature); err != nil {
-		return err
+	v := d.Verifier
+	if v == nil {
+		v = &Verifier{}
+	}
+	if err := v.Check(mainFile, sigFile); err != nil {
+		serr := &SignatureError{URL: u, Err: err}
+		if d.Quarantine != nil {
+			rec := &QuarantineRecord{
+				URL:             u.String(),
+				SignatureURL:    sigURL.String(),
+				Time:            time.Now(),
+				Header:          p.header,
+				SignatureHeader: sigSrc.Header,
+				Error:           err.Error(),
+			}
+			dir, err := d.Quarantine.store(rec, path.Base(u.Path), mainFile, sigFile)
+			if err != nil {
+				log.Printf("cannot quarantine %v: %v", u, err)
+			}
+			serr.Quarantine = dir
+		}
+		// not worth resuming
+		p.remove()
+		return serr
 	}
 
 	if err := sigFile.Close(); err != nil {
@@ -77,10 +305,143 @@ func Download(ctx context.Context, dst string, u *url.URL) error {
 	if err := mainFile.Close(); err != nil {
 		return err
 	}
-	if err := os.Rename(mainFile.Name(), path.Join(dst, path.Base(u.Path))); err != nil {
+	mainFile = nil
+	if err := os.Rename(p.path, path.Join(dst, path.Base(u.Path))); err != nil {
 		return err
 	}
-	mainFile = nil
+	if err := os.Remove(p.validator); err != nil && !os.IsNotExist(err) {
+		log.Printf("cannot clean up temp file: %v", err)
+	}
+
+	return nil
+}
+
+// partial is a download that may have been interrupted earlier.
+type partial struct {
+	// path holds the content downloaded so far.
+	path string
+	// validator holds the validator of the source file that path
+	// came from, like an ETag, so we can tell whether the remote
+	// file has changed since.
+	validator string
+	// header is from the last response, if the source is HTTP.
+	header http.Header
+}
+
+func (p *partial) remove() {
+	for _, name := range []string{p.path, p.validator} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			log.Printf("cannot clean up temp file: %v", err)
+		}
+	}
+}
+
+// fetch downloads u into the partial file, resuming from where an
+// earlier attempt stopped. It returns the file, positioned at the
+// start, once the download is complete. If there is an error, the
+// content downloaded so far is kept.
+func (p *partial) fetch(ctx context.Context, d *Downloader, u *url.URL) (*os.File, error) {
+	f, err := os.OpenFile(p.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.fetchInto(ctx, d, f, u); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (p *partial) fetchInto(ctx context.Context, d *Downloader, f *os.File, u *url.URL) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset := fi.Size()
+	var validator string
+	if offset > 0 {
+		buf, err := ioutil.ReadFile(p.validator)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		validator = string(buf)
+		if validator == "" {
+			// cannot know whether it's still the same file
+			offset = 0
+		}
+	}
+
+	src, err := d.source().Open(ctx, u, offset, validator)
+	if err != nil {
+		return err
+	}
+	defer src.Body.Close()
+	offset = src.Offset
+	if d.Started != nil {
+		d.Started(offset)
+	}
 
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	p.header = src.Header
+	if err := p.saveValidator(src.Validator); err != nil {
+		return err
+	}
+	var w io.Writer = f
+	if d.Progress != nil {
+		pw := &progressWriter{w: f, n: offset, total: src.Size, fn: d.Progress}
+		defer pw.report()
+		w = pw
+	}
+	if _, err := io.Copy(w, d.body(ctx, src)); err != nil {
+		return err
+	}
 	return nil
 }
+
+// progressWriter tells how much has been written, at most once every
+// progressInterval.
+type progressWriter struct {
+	w     io.Writer
+	n     int64
+	total int64
+	fn    func(n, total int64)
+	last  time.Time
+}
+
+const progressInterval = time.Second
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.n += int64(n)
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		p.fn(p.n, p.total)
+	}
+	return n, err
+}
+
+func (p *progressWriter) report() {
+	p.fn(p.n, p.total)
+}
+
+// saveValidator remembers what version of the file is being
+// downloaded, for resuming.
+func (p *partial) saveValidator(validator string) error {
+	if validator == "" {
+		// not resumable
+		if err := os.Remove(p.validator); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return ioutil.WriteFile(p.validator, []byte(validator), 0644)
+}
@@ -0,0 +1,192 @@
+package sig_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"eagain.net/go/oppositus/sig"
+	"golang.org/x/net/context"
+)
+
+type testServer struct {
+	*httptest.Server
+	ranges []string
+}
+
+// newTestServer serves a signed file as /version.txt, with support
+// for range requests.
+func newTestServer(t testing.TB, content []byte) *testServer {
+	signature, err := ioutil.ReadFile("../testdata/version.txt.sig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &testServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/version.txt", func(w http.ResponseWriter, req *http.Request) {
+		srv.ranges = append(srv.ranges, req.Header.Get("Range"))
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, req, "version.txt", time.Time{}, bytes.NewReader(content))
+	})
+	mux.HandleFunc("/version.txt.sig", func(w http.ResponseWriter, req *http.Request) {
+		http.ServeContent(w, req, "version.txt.sig", time.Time{}, bytes.NewReader(signature))
+	})
+	srv.Server = httptest.NewServer(mux)
+	return srv
+}
+
+func download(t testing.TB, srv *testServer, dst string) error {
+	u, err := url.Parse(srv.URL + "/version.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig.Download(context.Background(), dst, u)
+}
+
+func TestDownload(t *testing.T) {
+	content, err := ioutil.ReadFile("../testdata/version.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t, content)
+	defer srv.Close()
+	dst, err := ioutil.TempDir("", "oppositus-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	if err := download(t, srv, dst); err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dst, "version.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("wrong content: %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "version.txt.sig")); err != nil {
+		t.Errorf("no signature: %v", err)
+	}
+	fis, err := ioutil.ReadDir(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 2 {
+		t.Errorf("temp files left behind: %d files", len(fis))
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	content, err := ioutil.ReadFile("../testdata/version.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t, content)
+	defer srv.Close()
+	dst, err := ioutil.TempDir("", "oppositus-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	// pretend an earlier download was interrupted
+	if err := ioutil.WriteFile(filepath.Join(dst, ".version.txt.partial"), content[:10], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dst, ".version.txt.partial.validator"), []byte(`"v1"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := download(t, srv, dst); err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	if g, e := srv.ranges, []string{"bytes=10-"}; len(g) != 1 || g[0] != e[0] {
+		t.Errorf("wrong range requests: %q != %q", g, e)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dst, "version.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("wrong content: %q", got)
+	}
+	for _, name := range []string{".version.txt.partial", ".version.txt.partial.validator"} {
+		if _, err := os.Stat(filepath.Join(dst, name)); !os.IsNotExist(err) {
+			t.Errorf("partial download left behind: %v: %v", name, err)
+		}
+	}
+}
+
+func TestDownloadResumeBadSignature(t *testing.T) {
+	content, err := ioutil.ReadFile("../testdata/version.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t, content)
+	defer srv.Close()
+	dst, err := ioutil.TempDir("", "oppositus-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	// an earlier download that does not match what the server has
+	if err := ioutil.WriteFile(filepath.Join(dst, ".version.txt.partial"), []byte("junkjunkjunk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dst, ".version.txt.partial.validator"), []byte(`"v1"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := download(t, srv, dst); err == nil {
+		t.Fatal("expected an error")
+	}
+	fis, err := ioutil.ReadDir(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range fis {
+		t.Errorf("file left behind: %v", fi.Name())
+	}
+}
+
+func TestDownloadResumeChanged(t *testing.T) {
+	content, err := ioutil.ReadFile("../testdata/version.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t, content)
+	defer srv.Close()
+	dst, err := ioutil.TempDir("", "oppositus-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	// the earlier download was of a different version of the file
+	if err := ioutil.WriteFile(filepath.Join(dst, ".version.txt.partial"), []byte("junkjunkjunk"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dst, ".version.txt.partial.validator"), []byte(`"v0"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := download(t, srv, dst); err != nil {
+		t.Fatalf("download: %v", err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dst, "version.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("wrong content: %q", got)
+	}
+}
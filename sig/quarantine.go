@@ -0,0 +1,158 @@
+package sig
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultQuarantineMaxBytes is the size cap of a Quarantine that does
+// not set one.
+const DefaultQuarantineMaxBytes = 1 << 30
+
+// QuarantineRecordName is the name of the JSON file that describes a
+// quarantined download.
+const QuarantineRecordName = "record.json"
+
+// errQuarantineFull means there is no room left even for the record.
+var errQuarantineFull = errors.New("quarantine is full")
+
+// Quarantine keeps downloads that fail signature verification, as
+// evidence. Every rejected download gets a directory of its own under
+// Dir, holding the file, its signature, and a QuarantineRecord. A
+// Quarantine may be shared by many Downloaders.
+type Quarantine struct {
+	// Dir is where the rejected downloads are kept. It is created
+	// if needed.
+	Dir string
+
+	// MaxBytes caps the total size of the files under Dir, so a
+	// hostile server cannot fill the disk. When a download does
+	// not fit, only its record is kept. If zero,
+	// DefaultQuarantineMaxBytes is used.
+	MaxBytes int64
+
+	mu sync.Mutex
+}
+
+// QuarantineRecord describes a quarantined download.
+type QuarantineRecord struct {
+	URL          string    `json:"url"`
+	SignatureURL string    `json:"signature_url"`
+	Time         time.Time `json:"time"`
+	// Header and SignatureHeader are the response headers. For a
+	// resumed download, Header is from the last response.
+	Header          http.Header `json:"header"`
+	SignatureHeader http.Header `json:"signature_header"`
+	// Error is the error from checking the signature.
+	Error         string `json:"error"`
+	Size          int64  `json:"size"`
+	SignatureSize int64  `json:"signature_size"`
+	// Discarded is true if the files did not fit under the size
+	// cap, and only the record was kept.
+	Discarded bool `json:"discarded,omitempty"`
+}
+
+func (q *Quarantine) maxBytes() int64 {
+	if q.MaxBytes == 0 {
+		return DefaultQuarantineMaxBytes
+	}
+	return q.MaxBytes
+}
+
+// usage returns the total size of the files under Dir.
+func (q *Quarantine) usage() (int64, error) {
+	var total int64
+	err := filepath.Walk(q.Dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			total += fi.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// store copies the rejected file and signature into a new directory
+// under Dir, and returns its path.
+func (q *Quarantine) store(rec *QuarantineRecord, name string, file, signature *os.File) (string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := os.MkdirAll(q.Dir, 0700); err != nil {
+		return "", err
+	}
+	used, err := q.usage()
+	if err != nil {
+		return "", err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	rec.Size = fi.Size()
+	sigFi, err := signature.Stat()
+	if err != nil {
+		return "", err
+	}
+	rec.SignatureSize = sigFi.Size()
+
+	buf, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	// leave room for setting Discarded
+	recSize := int64(len(buf)) + 32
+	switch {
+	case used+recSize+rec.Size+rec.SignatureSize <= q.maxBytes():
+	case used+recSize <= q.maxBytes():
+		rec.Discarded = true
+	default:
+		return "", errQuarantineFull
+	}
+
+	dir, err := ioutil.TempDir(q.Dir, rec.Time.UTC().Format("20060102T150405Z")+"-"+name+".")
+	if err != nil {
+		return "", err
+	}
+	if !rec.Discarded {
+		if err := copyFile(filepath.Join(dir, name), file); err != nil {
+			return dir, err
+		}
+		if err := copyFile(filepath.Join(dir, name+".sig"), signature); err != nil {
+			return dir, err
+		}
+	}
+	buf, err = json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return dir, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, QuarantineRecordName), append(buf, '\n'), 0600); err != nil {
+		return dir, err
+	}
+	return dir, nil
+}
+
+// copyFile copies all of src into a new file at p.
+func copyFile(p string, src *os.File) error {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		_ = dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,91 @@
+package sig_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"eagain.net/go/oppositus/sig"
+	"golang.org/x/net/context"
+)
+
+func TestQuarantine(t *testing.T) {
+	evil := []byte("evil\n")
+	tests := []struct {
+		maxBytes  int64
+		kept      bool
+		discarded bool
+	}{
+		{maxBytes: 0, kept: true},
+		{maxBytes: 1000, kept: true, discarded: true},
+		{maxBytes: 100, kept: false},
+	}
+	for i, test := range tests {
+		srv := newTestServer(t, evil)
+		dst, err := ioutil.TempDir("", "oppositus-test-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := &sig.Quarantine{
+			Dir:      filepath.Join(dst, "quarantine"),
+			MaxBytes: test.maxBytes,
+		}
+		u, err := url.Parse(srv.URL + "/version.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := sig.Downloader{Quarantine: q}
+		err = d.Download(context.Background(), dst, u)
+		serr, ok := err.(*sig.SignatureError)
+		if !ok {
+			t.Fatalf("#%d: expected a signature error: %v", i, err)
+		}
+		if _, err := os.Stat(filepath.Join(dst, "version.txt")); !os.IsNotExist(err) {
+			t.Errorf("#%d: bad file was kept: %v", i, err)
+		}
+		if !test.kept {
+			if serr.Quarantine != "" {
+				t.Errorf("#%d: quarantined despite the cap: %v", i, serr.Quarantine)
+			}
+			srv.Close()
+			os.RemoveAll(dst)
+			continue
+		}
+		if filepath.Dir(serr.Quarantine) != q.Dir {
+			t.Fatalf("#%d: not quarantined: %q", i, serr.Quarantine)
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(serr.Quarantine, sig.QuarantineRecordName))
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		var rec sig.QuarantineRecord
+		if err := json.Unmarshal(buf, &rec); err != nil {
+			t.Fatalf("#%d: bad record: %v", i, err)
+		}
+		if g, e := rec.URL, u.String(); g != e {
+			t.Errorf("#%d: wrong URL: %q != %q", i, g, e)
+		}
+		if g, e := rec.Header.Get("ETag"), `"v1"`; g != e {
+			t.Errorf("#%d: wrong headers: %q != %q", i, g, e)
+		}
+		if rec.Error == "" {
+			t.Errorf("#%d: no error recorded", i)
+		}
+		if g, e := rec.Discarded, test.discarded; g != e {
+			t.Errorf("#%d: wrong discarded: %v != %v", i, g, e)
+		}
+		got, err := ioutil.ReadFile(filepath.Join(serr.Quarantine, "version.txt"))
+		if test.discarded {
+			if !os.IsNotExist(err) {
+				t.Errorf("#%d: file kept despite the cap: %v", i, err)
+			}
+		} else if err != nil || string(got) != string(evil) {
+			t.Errorf("#%d: wrong file kept: %q: %v", i, got, err)
+		}
+		srv.Close()
+		os.RemoveAll(dst)
+	}
+}
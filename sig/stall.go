@@ -0,0 +1,89 @@
+package sig
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// StallError means no data arrived for the idle timeout, and the
+// download was aborted. What was downloaded so far is kept for
+// resuming.
+type StallError struct {
+	URL     *url.URL
+	Timeout time.Duration
+}
+
+func (e *StallError) Error() string {
+	return fmt.Sprintf("download stalled: no data for %v: %v", e.Timeout, e.URL)
+}
+
+// watchdog cancels a context when it has not been kicked for too
+// long. A nil watchdog does nothing.
+type watchdog struct {
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  func()
+	fired   int32
+}
+
+// newWatchdog returns a context that is canceled if the watchdog is
+// not kicked at least every timeout. The caller must call stop.
+func newWatchdog(ctx context.Context, timeout time.Duration) (context.Context, *watchdog) {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &watchdog{timeout: timeout, cancel: cancel}
+	w.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&w.fired, 1)
+		cancel()
+	})
+	return ctx, w
+}
+
+// kick restarts the wait, also after a pause.
+func (w *watchdog) kick() {
+	if w == nil {
+		return
+	}
+	w.timer.Reset(w.timeout)
+}
+
+// pause stops waiting until the next kick, for when we are the ones
+// not reading.
+func (w *watchdog) pause() {
+	if w == nil {
+		return
+	}
+	w.timer.Stop()
+}
+
+// stop stops waiting, and releases the context.
+func (w *watchdog) stop() {
+	if w == nil {
+		return
+	}
+	w.timer.Stop()
+	w.cancel()
+}
+
+// stalled reports whether the watchdog canceled the context.
+func (w *watchdog) stalled() bool {
+	return w != nil && atomic.LoadInt32(&w.fired) != 0
+}
+
+// kickReader kicks the watchdog whenever data arrives.
+type kickReader struct {
+	r io.Reader
+	w *watchdog
+}
+
+func (r *kickReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.w.kick()
+	}
+	return n, err
+}
@@ -0,0 +1,61 @@
+package sig_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"eagain.net/go/oppositus/sig"
+	"golang.org/x/net/context"
+)
+
+func TestDownloadStall(t *testing.T) {
+	content, err := ioutil.ReadFile("../testdata/version.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := ioutil.ReadFile("../testdata/version.txt.sig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/version.txt", func(w http.ResponseWriter, req *http.Request) {
+		// send half, then hang
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write(content[:len(content)/2])
+		w.(http.Flusher).Flush()
+		<-req.Context().Done()
+	})
+	mux.HandleFunc("/version.txt.sig", func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write(signature)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	dst, err := ioutil.TempDir("", "oppositus-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+
+	u, err := url.Parse(srv.URL + "/version.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := sig.Downloader{IdleTimeout: 100 * time.Millisecond}
+	err = d.Download(context.Background(), dst, u)
+	if _, ok := err.(*sig.StallError); !ok {
+		t.Fatalf("expected a stall: %v", err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dst, ".version.txt.partial"))
+	if err != nil {
+		t.Fatalf("partial download not kept: %v", err)
+	}
+	if g, e := len(got), len(content)/2; g != e {
+		t.Errorf("wrong partial size: %d != %d", g, e)
+	}
+}
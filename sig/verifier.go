@@ -0,0 +1,179 @@
+package sig
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// DefaultKeyring returns the CoreOS Image Signing Key, which is built
+// in.
+func DefaultKeyring() openpgp.EntityList {
+	return append(openpgp.EntityList(nil), coreosKey...)
+}
+
+// ReadKeyring reads public keys, in either ASCII armored or binary
+// form.
+func ReadKeyring(r io.Reader) (openpgp.EntityList, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len("-----BEGIN"))
+	if err == nil && string(head) == "-----BEGIN" {
+		return openpgp.ReadArmoredKeyRing(br)
+	}
+	return openpgp.ReadKeyRing(br)
+}
+
+// KeyPolicy says when a key is trusted.
+type KeyPolicy struct {
+	// Fingerprint is the hex fingerprint of the primary key, like
+	// "04127D0BFABEC8871FFB2CCE50E0885593D2DCB4". Spaces are
+	// ignored.
+	Fingerprint string
+
+	// NotBefore and NotAfter limit the signatures accepted to those
+	// made in between, as told by the signature itself. Zero means
+	// no limit. Signatures made by the key's subkeys count as made
+	// by the key.
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// Verifier checks signatures against a set of trusted keys. The zero
+// value trusts only the CoreOS Image Signing Key.
+type Verifier struct {
+	keyring openpgp.EntityList
+	// policies are by fingerprint; if nil, every key in keyring is
+	// trusted at all times
+	policies map[[20]byte]KeyPolicy
+}
+
+// NewVerifier returns a Verifier trusting the keys in keyring. If
+// policies are given, only the keys they name are trusted, and only
+// within their validity windows; naming a key that is not in keyring
+// is an error.
+//
+// To trust more than one keyring, such as DefaultKeyring and a key of
+// one's own, append them together.
+func NewVerifier(keyring openpgp.EntityList, policies ...KeyPolicy) (*Verifier, error) {
+	if len(keyring) == 0 {
+		return nil, fmt.Errorf("no keys to trust")
+	}
+	if len(policies) == 0 {
+		return &Verifier{keyring: keyring}, nil
+	}
+	v := &Verifier{policies: make(map[[20]byte]KeyPolicy)}
+	for _, p := range policies {
+		fp, err := parseFingerprint(p.Fingerprint)
+		if err != nil {
+			return nil, err
+		}
+		if !p.NotBefore.IsZero() && !p.NotAfter.IsZero() && p.NotAfter.Before(p.NotBefore) {
+			return nil, fmt.Errorf("key %X is never valid: %v is before %v", fp, p.NotAfter, p.NotBefore)
+		}
+		v.policies[fp] = p
+	}
+	seen := make(map[[20]byte]bool)
+	for _, e := range keyring {
+		fp := e.PrimaryKey.Fingerprint
+		if _, ok := v.policies[fp]; ok && !seen[fp] {
+			seen[fp] = true
+			v.keyring = append(v.keyring, e)
+		}
+	}
+	for fp := range v.policies {
+		if !seen[fp] {
+			return nil, fmt.Errorf("key %X is not in the keyring", fp)
+		}
+	}
+	return v, nil
+}
+
+func parseFingerprint(s string) ([20]byte, error) {
+	var fp [20]byte
+	buf, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil || len(buf) != len(fp) {
+		return fp, fmt.Errorf("bad key fingerprint: %q", s)
+	}
+	copy(fp[:], buf)
+	return fp, nil
+}
+
+// maxSignatureSize is the most read of a detached signature.
+const maxSignatureSize = 64 * 1024
+
+// Check ensures that signed has been signed with one of the trusted
+// keys, at a time the key is trusted.
+func (v *Verifier) Check(signed io.Reader, signature io.Reader) error {
+	keyring := v.keyring
+	if keyring == nil {
+		keyring = coreosKey
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(signature, maxSignatureSize))
+	if err != nil {
+		return err
+	}
+	signer, err := openpgp.CheckDetachedSignature(keyring, signed, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	if v.policies == nil {
+		return nil
+	}
+	p := v.policies[signer.PrimaryKey.Fingerprint]
+	if p.NotBefore.IsZero() && p.NotAfter.IsZero() {
+		return nil
+	}
+	made, err := signatureTime(keyring, buf)
+	if err != nil {
+		return err
+	}
+	if !p.NotBefore.IsZero() && made.Before(p.NotBefore) || !p.NotAfter.IsZero() && made.After(p.NotAfter) {
+		return fmt.Errorf("signature made at %v by key %X, which is not trusted then", made.UTC(), signer.PrimaryKey.Fingerprint)
+	}
+	return nil
+}
+
+// signatureTime returns when the detached signature that was checked
+// says it was made. A file can hold many signatures; like
+// openpgp.CheckDetachedSignature, this picks the first one made by a
+// key in keyring, so the time is that of the signature that was
+// actually checked.
+func signatureTime(keyring openpgp.KeyRing, buf []byte) (time.Time, error) {
+	packets := packet.NewReader(bytes.NewReader(buf))
+	for {
+		p, err := packets.Next()
+		if err != nil {
+			if err == io.EOF {
+				err = errors.New("no signature by a trusted key")
+			}
+			return time.Time{}, err
+		}
+		var (
+			issuer uint64
+			made   time.Time
+		)
+		switch s := p.(type) {
+		case *packet.Signature:
+			if s.IssuerKeyId == nil {
+				return time.Time{}, errors.New("signature doesn't have an issuer")
+			}
+			issuer, made = *s.IssuerKeyId, s.CreationTime
+		case *packet.SignatureV3:
+			issuer, made = s.IssuerKeyId, s.CreationTime
+		default:
+			return time.Time{}, fmt.Errorf("not a signature: %T", p)
+		}
+		if len(keyring.KeysByIdUsage(issuer, packet.KeyFlagSign)) > 0 {
+			return made, nil
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package sig_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"eagain.net/go/oppositus/sig"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// newKey makes a signing key for tests.
+func newKey(t testing.TB) *openpgp.Entity {
+	e, err := openpgp.NewEntity("Test Signing Key", "", "test@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// sign makes a detached signature of data, made at the given time.
+func sign(t testing.TB, e *openpgp.Entity, data string, at time.Time) []byte {
+	var buf bytes.Buffer
+	config := &packet.Config{Time: func() time.Time { return at }}
+	if err := openpgp.DetachSign(&buf, e, strings.NewReader(data), config); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func fingerprint(e *openpgp.Entity) string {
+	return fmt.Sprintf("%X", e.PrimaryKey.Fingerprint)
+}
+
+// coreosSigned returns the test file signed by CoreOS, and its
+// signature.
+func coreosSigned(t testing.TB) (data string, signature []byte) {
+	buf, err := ioutil.ReadFile("../testdata/version.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err = ioutil.ReadFile("../testdata/version.txt.sig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf), signature
+}
+
+func TestVerifierZero(t *testing.T) {
+	data, signature := coreosSigned(t)
+	var v sig.Verifier
+	if err := v.Check(strings.NewReader(data), bytes.NewReader(signature)); err != nil {
+		t.Errorf("CoreOS signature rejected: %v", err)
+	}
+	own := sign(t, newKey(t), data, time.Now())
+	if err := v.Check(strings.NewReader(data), bytes.NewReader(own)); err == nil {
+		t.Error("signature by unknown key accepted")
+	}
+}
+
+func TestVerifierKeyrings(t *testing.T) {
+	data, signature := coreosSigned(t)
+	key := newKey(t)
+	own := sign(t, key, data, time.Now())
+
+	tests := []struct {
+		name            string
+		keyring         openpgp.EntityList
+		coreos, ownGood bool
+	}{
+		{"own", openpgp.EntityList{key}, false, true},
+		{"both", append(sig.DefaultKeyring(), key), true, true},
+	}
+	for _, test := range tests {
+		v, err := sig.NewVerifier(test.keyring)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = v.Check(strings.NewReader(data), bytes.NewReader(signature))
+		if ok := err == nil; ok != test.coreos {
+			t.Errorf("%v: CoreOS signature: %v", test.name, err)
+		}
+		err = v.Check(strings.NewReader(data), bytes.NewReader(own))
+		if ok := err == nil; ok != test.ownGood {
+			t.Errorf("%v: own signature: %v", test.name, err)
+		}
+	}
+}
+
+func TestVerifierPolicies(t *testing.T) {
+	data, signature := coreosSigned(t)
+	oldKey := newKey(t)
+	newKey := newKey(t)
+	rotation := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	v, err := sig.NewVerifier(
+		openpgp.EntityList{oldKey, newKey, sig.DefaultKeyring()[0]},
+		sig.KeyPolicy{Fingerprint: fingerprint(oldKey), NotAfter: rotation},
+		sig.KeyPolicy{Fingerprint: fingerprint(newKey), NotBefore: rotation.Add(-24 * time.Hour)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  *openpgp.Entity
+		at   time.Time
+		ok   bool
+	}{
+		{"old key before rotation", oldKey, rotation.Add(-time.Hour), true},
+		{"old key after rotation", oldKey, rotation.Add(time.Hour), false},
+		{"new key before rotation", newKey, rotation.Add(-time.Hour), true},
+		{"new key too early", newKey, rotation.Add(-48 * time.Hour), false},
+		{"new key after rotation", newKey, rotation.Add(time.Hour), true},
+	}
+	for _, test := range tests {
+		signature := sign(t, test.key, data, test.at)
+		err := v.Check(strings.NewReader(data), bytes.NewReader(signature))
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("%v: wrong result: %v", test.name, err)
+		}
+	}
+
+	// keys without a policy are not trusted, even if in the keyring
+	if err := v.Check(strings.NewReader(data), bytes.NewReader(signature)); err == nil {
+		t.Error("key without a policy trusted")
+	}
+}
+
+func TestVerifierPrependedSignature(t *testing.T) {
+	data, _ := coreosSigned(t)
+	key := newKey(t)
+	notAfter := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	v, err := sig.NewVerifier(openpgp.EntityList{key},
+		sig.KeyPolicy{Fingerprint: fingerprint(key), NotAfter: notAfter},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := sign(t, key, data, notAfter.Add(time.Hour))
+	// a signature by an unknown key, claiming a time within the
+	// window, must not lend its time to the one that gets checked
+	decoy := sign(t, newKey(t), data, notAfter.Add(-time.Hour))
+	signature := append(append([]byte(nil), decoy...), expired...)
+	if err := v.Check(strings.NewReader(data), bytes.NewReader(signature)); err == nil {
+		t.Error("signature made after the window accepted")
+	}
+
+	good := sign(t, key, data, notAfter.Add(-time.Hour))
+	signature = append(append([]byte(nil), decoy...), good...)
+	if err := v.Check(strings.NewReader(data), bytes.NewReader(signature)); err != nil {
+		t.Errorf("signature within the window rejected: %v", err)
+	}
+}
+
+func TestVerifierUnknownFingerprint(t *testing.T) {
+	_, err := sig.NewVerifier(sig.DefaultKeyring(),
+		sig.KeyPolicy{Fingerprint: fingerprint(newKey(t))},
+	)
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestVerifierBadFingerprint(t *testing.T) {
+	_, err := sig.NewVerifier(sig.DefaultKeyring(), sig.KeyPolicy{Fingerprint: "04127D0B"})
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestReadKeyring(t *testing.T) {
+	key := newKey(t)
+	var binary bytes.Buffer
+	if err := key.Serialize(&binary); err != nil {
+		t.Fatal(err)
+	}
+	var armored bytes.Buffer
+	w, err := armor.Encode(&armored, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(binary.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, buf := range map[string][]byte{
+		"binary":  binary.Bytes(),
+		"armored": armored.Bytes(),
+	} {
+		keyring, err := sig.ReadKeyring(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if len(keyring) != 1 || fingerprint(keyring[0]) != fingerprint(key) {
+			t.Errorf("%v: wrong keys: %v", name, keyring)
+		}
+	}
+
+	f, err := os.Open("coreosKey.asc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	keyring, err := sig.ReadKeyring(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := fingerprint(keyring[0]), fingerprint(sig.DefaultKeyring()[0]); g != e {
+		t.Errorf("wrong CoreOS key: %v != %v", g, e)
+	}
+}
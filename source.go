@@ -0,0 +1,86 @@
+package oppositus
+
+import (
+	"net/url"
+
+	"eagain.net/go/oppositus/source"
+	"golang.org/x/net/context"
+)
+
+// cacheDir is where version.txt files and directory listings are
+// cached under the destination, for conditional requests.
+const cacheDir = ".cache"
+
+// WithSource sets where releases are fetched from. By default, http
+// and https URLs are fetched with the client set with
+// WithHTTPClient, caching small files under the destination
+// directory, and file URLs are read from the local filesystem. The
+// URLs are made from the base URL set with WithBaseURL, and signatures
+// are checked no matter where the files come from.
+func WithSource(s source.Source) Option {
+	return func(conf *config) error {
+		conf.source = s
+		return nil
+	}
+}
+
+// defaultSource returns the source used when none is set with
+// WithSource, caching under cache if it is not empty.
+func defaultSource(conf *config, cache string) source.Source {
+	h := &source.HTTP{
+		Client:   conf.client,
+		CacheDir: cache,
+	}
+	return source.Schemes{
+		"http":  h,
+		"https": h,
+		"file":  source.Local{},
+	}
+}
+
+// fetch returns the content of the small file at u, while obeying the
+// per-host concurrency limit and the retry policy.
+func (m *mirrorer) fetch(ctx context.Context, u *url.URL) ([]byte, error) {
+	var body []byte
+	err := m.retry(ctx, u, func() error {
+		release, err := m.limiter.acquire(ctx, u.Host)
+		if err != nil {
+			return err
+		}
+		defer release()
+		body, err = m.source.ReadFile(ctx, u)
+		return err
+	})
+	return body, err
+}
+
+// list returns the links in the directory listing at u.
+func (m *mirrorer) list(ctx context.Context, u *url.URL) ([]string, error) {
+	var links []string
+	err := m.retry(ctx, u, func() error {
+		release, err := m.limiter.acquire(ctx, u.Host)
+		if err != nil {
+			return err
+		}
+		defer release()
+		links, err = m.source.List(ctx, u)
+		return err
+	})
+	return links, err
+}
+
+// size asks for the size of the file at u, returning -1 if the source
+// does not say.
+func (m *mirrorer) size(ctx context.Context, u *url.URL) (int64, error) {
+	var size int64
+	err := m.retry(ctx, u, func() error {
+		release, err := m.limiter.acquire(ctx, u.Host)
+		if err != nil {
+			return err
+		}
+		defer release()
+		size, err = m.source.Size(ctx, u)
+		return err
+	})
+	return size, err
+}
@@ -0,0 +1,96 @@
+package source
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// cacheEntry is a cached response.
+type cacheEntry struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Body         []byte `json:"body"`
+}
+
+// responseCache keeps responses in files named after the hash of the
+// URL. A nil cache keeps nothing.
+type responseCache struct {
+	dir string
+}
+
+func (c *responseCache) path(u *url.URL) string {
+	sum := sha256.Sum256([]byte(u.String()))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// load returns the cached response for u, or nil if there is none.
+func (c *responseCache) load(u *url.URL) *cacheEntry {
+	if c == nil {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(c.path(u))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("cannot read cache: %v", err)
+		}
+		return nil
+	}
+	var e cacheEntry
+	if err := json.Unmarshal(buf, &e); err != nil || e.URL != u.String() {
+		// corrupt, or a hash collision; just fetch it again
+		return nil
+	}
+	return &e
+}
+
+// store caches a response, if it has validators to use in
+// conditional requests.
+func (c *responseCache) store(u *url.URL, h http.Header, body []byte) error {
+	if c == nil {
+		return nil
+	}
+	e := cacheEntry{
+		URL:          u.String(),
+		ETag:         h.Get("ETag"),
+		LastModified: h.Get("Last-Modified"),
+		Body:         body,
+	}
+	p := c.path(u)
+	if e.ETag == "" && e.LastModified == "" {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(c.dir, "."+filepath.Base(p)+".tmp.")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package source
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"eagain.net/go/oppositus/internal/href"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// HTTP fetches from web servers. Directories are read from the HTML
+// listings the servers generate. The zero value is ready to use.
+type HTTP struct {
+	// Client is used for the requests. If nil, http.DefaultClient
+	// is used.
+	Client *http.Client
+
+	// CacheDir, if set, is where small files and directory
+	// listings are cached. They are only fetched again if the
+	// server says they have changed.
+	CacheDir string
+}
+
+// ReadFile fetches the file. Responses other than 200 OK and 304 Not
+// Modified are a *StatusError.
+func (h *HTTP) ReadFile(ctx context.Context, u *url.URL) ([]byte, error) {
+	var cache *responseCache
+	if h.CacheDir != "" {
+		cache = &responseCache{dir: h.CacheDir}
+	}
+	cached := cache.load(u)
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	resp, err := ctxhttp.Do(ctx, h.Client, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		return cached.Body, nil
+	case resp.StatusCode == http.StatusOK:
+		buf, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if err := cache.store(u, resp.Header, buf); err != nil {
+			// only makes the next run a little slower
+			log.Printf("cannot write cache: %v", err)
+		}
+		return buf, nil
+	}
+	return nil, &StatusError{URL: u, StatusCode: resp.StatusCode, Status: resp.Status}
+}
+
+// List fetches the directory listing, and returns the links in it.
+func (h *HTTP) List(ctx context.Context, u *url.URL) ([]string, error) {
+	buf, err := h.ReadFile(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	var links []string
+	hrefs := href.New(bytes.NewReader(buf))
+	for {
+		link, err := hrefs.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// Size asks the server for the size of the file.
+func (h *HTTP) Size(ctx context.Context, u *url.URL) (int64, error) {
+	req, err := http.NewRequest("HEAD", u.String(), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := ctxhttp.Do(ctx, h.Client, req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, &StatusError{URL: u, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	return resp.ContentLength, nil
+}
+
+// Open requests the file, resuming with a range request if the server
+// supports them. The validator is the ETag, or the Last-Modified time,
+// of the response.
+func (h *HTTP) Open(ctx context.Context, u *url.URL, offset int64, validator string) (*File, error) {
+	if validator == "" {
+		// cannot know whether it's still the same file
+		offset = 0
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		req.Header.Set("If-Range", validator)
+	}
+	resp, err := ctxhttp.Do(ctx, h.Client, req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, err := contentRangeStart(resp.Header.Get("Content-Range"))
+		if err == nil && start != offset {
+			err = fmt.Errorf("asked for range starting at %d, got %d", offset, start)
+		}
+		if err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("cannot fetch %v: %v", u, err)
+		}
+	case http.StatusOK:
+		// file changed, or server ignores ranges; start over
+		offset = 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		// we have more than the server does, so the file must
+		// have changed; try again from scratch
+		resp.Body.Close()
+		return h.Open(ctx, u, 0, "")
+	default:
+		resp.Body.Close()
+		return nil, &StatusError{URL: u, StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	size := resp.ContentLength
+	if size >= 0 {
+		size += offset
+	}
+	return &File{
+		Body:      resp.Body,
+		Offset:    offset,
+		Size:      size,
+		Validator: httpValidator(resp.Header),
+		Header:    resp.Header,
+	}, nil
+}
+
+// httpValidator returns what identifies the version of the file in a
+// response, for use in If-Range.
+func httpValidator(h http.Header) string {
+	validator := h.Get("ETag")
+	if strings.HasPrefix(validator, "W/") {
+		// weak validators cannot be used for ranges
+		validator = ""
+	}
+	if validator == "" {
+		validator = h.Get("Last-Modified")
+	}
+	return validator
+}
+
+// contentRangeStart parses the start offset from a Content-Range
+// header like "bytes 100-199/200".
+func contentRangeStart(s string) (int64, error) {
+	const prefix = "bytes "
+	if !strings.HasPrefix(s, prefix) {
+		return 0, fmt.Errorf("bad Content-Range: %q", s)
+	}
+	s = s[len(prefix):]
+	idx := strings.IndexByte(s, '-')
+	if idx == -1 {
+		return 0, fmt.Errorf("bad Content-Range: %q", s)
+	}
+	start, err := strconv.ParseInt(s[:idx], 10, 64)
+	if err != nil {
+		return 0, errors.New("bad Content-Range start")
+	}
+	return start, nil
+}
@@ -0,0 +1,135 @@
+package source
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/net/context"
+)
+
+// Local reads file:// URLs, like "file:///media/usb/{channel}/" as a
+// base URL. The directory needs the same layout as a release server:
+// channel directories holding version directories, with current/
+// being the version the channel is at. Symlinks are followed, so
+// another mirror works too.
+type Local struct{}
+
+func (Local) path(u *url.URL) (string, error) {
+	if u.Scheme != "file" || u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("not a local file: %v", u)
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+// ReadFile reads the file.
+func (l Local) ReadFile(ctx context.Context, u *url.URL) ([]byte, error) {
+	p, err := l.path(u)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(p)
+}
+
+// List reads the directory. Hidden files are left out.
+func (l Local) List(ctx context.Context, u *url.URL) ([]string, error) {
+	p, err := l.path(u)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	var links []string
+	for _, name := range names {
+		if name[0] == '.' {
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(p, name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// dangling symlink
+				continue
+			}
+			return nil, err
+		}
+		link := (&url.URL{Path: name}).EscapedPath()
+		if fi.IsDir() {
+			link += "/"
+		}
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+// Size returns the size of the file.
+func (l Local) Size(ctx context.Context, u *url.URL) (int64, error) {
+	p, err := l.path(u)
+	if err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// Open opens the file. The validator is made of its size and
+// modification time.
+func (l Local) Open(ctx context.Context, u *url.URL, offset int64, validator string) (*File, error) {
+	p, err := l.path(u)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, fmt.Errorf("not a regular file: %v", p)
+	}
+	current := fmt.Sprintf("%d-%d", fi.Size(), fi.ModTime().UnixNano())
+	if validator != current || offset > fi.Size() {
+		offset = 0
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &File{
+		Body:      &ctxReader{ctx: ctx, File: f},
+		Offset:    offset,
+		Size:      fi.Size(),
+		Validator: current,
+	}, nil
+}
+
+// ctxReader stops reading once the context is done, like HTTP
+// response bodies do.
+type ctxReader struct {
+	ctx context.Context
+	*os.File
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.File.Read(p)
+}
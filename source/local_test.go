@@ -0,0 +1,107 @@
+package source_test
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"eagain.net/go/oppositus/source"
+	"golang.org/x/net/context"
+)
+
+var _ source.Source = source.Local{}
+
+func fileURL(p string) *url.URL {
+	return &url.URL{Scheme: "file", Path: filepath.ToSlash(p)}
+}
+
+func TestLocalList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oppositus-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a b", ".hidden", "100%"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "1.0.0"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("1.0.0", filepath.Join(dir, "current")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("missing", filepath.Join(dir, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+
+	links, err := source.Local{}.List(context.Background(), fileURL(dir+"/"))
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	sort.Strings(links)
+	if e := []string{"1.0.0/", "100%25", "a%20b", "current/"}; !reflect.DeepEqual(links, e) {
+		t.Errorf("wrong links: %q != %q", links, e)
+	}
+}
+
+func TestLocalOpenResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oppositus-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(p, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	var l source.Local
+
+	read := func(f *source.File) string {
+		defer f.Body.Close()
+		buf, err := ioutil.ReadAll(f.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf)
+	}
+	f, err := l.Open(ctx, fileURL(p), 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator := f.Validator
+	if g, e := f.Size, int64(10); g != e {
+		t.Errorf("wrong size: %d != %d", g, e)
+	}
+	if g, e := read(f), "0123456789"; g != e {
+		t.Errorf("wrong content: %q != %q", g, e)
+	}
+
+	f, err = l.Open(ctx, fileURL(p), 4, validator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := f.Offset, int64(4); g != e {
+		t.Errorf("wrong offset: %d != %d", g, e)
+	}
+	if g, e := read(f), "456789"; g != e {
+		t.Errorf("wrong resumed content: %q != %q", g, e)
+	}
+
+	f, err = l.Open(ctx, fileURL(p), 4, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := f.Offset, int64(0); g != e {
+		t.Errorf("resumed changed file: %d != %d", g, e)
+	}
+	if g, e := read(f), "0123456789"; g != e {
+		t.Errorf("wrong content: %q != %q", g, e)
+	}
+}
@@ -0,0 +1,118 @@
+// Package source fetches releases from upstream: from HTTP servers,
+// or from a local directory with file:// URLs, such as a USB stick
+// for seeding a mirror without network access.
+//
+// Sources only fetch; signatures are checked by the sig package, no
+// matter where the files came from.
+package source
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/context"
+)
+
+// Source is where releases are fetched from. URLs are those of the
+// release server layout, like
+// "https://stable.release.core-os.net/amd64-usr/current/version.txt".
+//
+// Source must be safe for concurrent use.
+type Source interface {
+	// ReadFile returns the content of a small file, like
+	// version.txt.
+	ReadFile(ctx context.Context, u *url.URL) ([]byte, error)
+
+	// List returns the entries of the directory u, as links
+	// relative to it: file names, and directory names followed by
+	// a slash, escaped like URL paths.
+	List(ctx context.Context, u *url.URL) ([]string, error)
+
+	// Size returns the size of the file u, or -1 if it is not
+	// known.
+	Size(ctx context.Context, u *url.URL) (int64, error)
+
+	// Open opens the file u. To resume an earlier download, offset
+	// is how much of it there is, and validator is the Validator
+	// of the File it came from; the content starts from offset if
+	// the file has not changed since.
+	Open(ctx context.Context, u *url.URL, offset int64, validator string) (*File, error)
+}
+
+// File is a file being read from a Source.
+type File struct {
+	Body io.ReadCloser
+	// Offset is where Body starts in the file. It is zero if the
+	// download could not be resumed.
+	Offset int64
+	// Size is the size of the whole file, or -1 if unknown.
+	Size int64
+	// Validator identifies this version of the file, for resuming.
+	// If empty, the download cannot be resumed.
+	Validator string
+	// Header is the HTTP response header, or nil for sources that
+	// have none.
+	Header http.Header
+}
+
+// StatusError means the server responded to a request with an
+// unexpected status.
+type StatusError struct {
+	URL        *url.URL
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("cannot fetch %v: %v", e.URL, e.Status)
+}
+
+// Schemes picks the source by the scheme of the URL, like "https" or
+// "file".
+type Schemes map[string]Source
+
+func (s Schemes) source(u *url.URL) (Source, error) {
+	src, ok := s[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("cannot fetch %v: unsupported scheme", u)
+	}
+	return src, nil
+}
+
+// ReadFile implements Source.
+func (s Schemes) ReadFile(ctx context.Context, u *url.URL) ([]byte, error) {
+	src, err := s.source(u)
+	if err != nil {
+		return nil, err
+	}
+	return src.ReadFile(ctx, u)
+}
+
+// List implements Source.
+func (s Schemes) List(ctx context.Context, u *url.URL) ([]string, error) {
+	src, err := s.source(u)
+	if err != nil {
+		return nil, err
+	}
+	return src.List(ctx, u)
+}
+
+// Size implements Source.
+func (s Schemes) Size(ctx context.Context, u *url.URL) (int64, error) {
+	src, err := s.source(u)
+	if err != nil {
+		return 0, err
+	}
+	return src.Size(ctx, u)
+}
+
+// Open implements Source.
+func (s Schemes) Open(ctx context.Context, u *url.URL, offset int64, validator string) (*File, error) {
+	src, err := s.source(u)
+	if err != nil {
+		return nil, err
+	}
+	return src.Open(ctx, u, offset, validator)
+}
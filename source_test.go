@@ -0,0 +1,115 @@
+package oppositus_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"eagain.net/go/oppositus"
+	"eagain.net/go/oppositus/channels"
+	"eagain.net/go/oppositus/sig"
+	"golang.org/x/net/context"
+)
+
+// localUpstream writes files into a directory laid out like a release
+// server, and returns a file URL for it.
+func localUpstream(t testing.TB, files map[string][]byte) (dir, baseURL string) {
+	dir = tempDir(t)
+	for name, data := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, "file://" + filepath.ToSlash(dir) + "/{channel}/"
+}
+
+func TestMirrorLocal(t *testing.T) {
+	src, baseURL := localUpstream(t, upstreamFiles(t))
+	defer os.RemoveAll(src)
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	_, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(baseURL),
+		oppositus.WithChannels(channels.Stable),
+	)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	for _, name := range []string{"version.txt", "version.txt.sig"} {
+		if _, err := os.Stat(filepath.Join(dst, "amd64-usr", "all", testVersion, name)); err != nil {
+			t.Errorf("not mirrored: %v", err)
+		}
+	}
+	target, err := os.Readlink(filepath.Join(dst, "amd64-usr", "stable", "current"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := target, "../all/"+testVersion; g != e {
+		t.Errorf("wrong current symlink: %q != %q", g, e)
+	}
+}
+
+func TestMirrorLocalFromMirror(t *testing.T) {
+	srv := newUpstream(t, upstreamFiles(t))
+	defer srv.Close()
+	seed := tempDir(t)
+	defer os.RemoveAll(seed)
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	if _, err := oppositus.Mirror(context.Background(), seed,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+	); err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	// channel directories of a mirror look like those of a release
+	// server, thanks to the symlinks
+	_, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL("file://"+filepath.ToSlash(seed)+"/{board}/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+	)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "amd64-usr", "stable", "current", "version.txt")); err != nil {
+		t.Errorf("not mirrored: %v", err)
+	}
+}
+
+func TestMirrorLocalBadSignature(t *testing.T) {
+	files := upstreamFiles(t)
+	files["stable/"+testVersion+"/version.txt"] = []byte("junk\n")
+	src, baseURL := localUpstream(t, files)
+	defer os.RemoveAll(src)
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	var errs []error
+	_, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(baseURL),
+		oppositus.WithChannels(channels.Stable),
+		oppositus.WithErrorHandler(func(err error) error {
+			errs = append(errs, err)
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	if len(errs) == 0 {
+		t.Fatal("expected errors")
+	}
+	if _, ok := errs[0].(*sig.SignatureError); !ok {
+		t.Errorf("expected signature error: %T: %v", errs[0], errs[0])
+	}
+	if _, err := os.Stat(filepath.Join(dst, "amd64-usr", "all", testVersion)); !os.IsNotExist(err) {
+		t.Errorf("version with bad signature was published: %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package oppositus
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"eagain.net/go/oppositus/internal/atomic"
+	"golang.org/x/net/context"
+)
+
+// Storage is where the mirror is kept. Files are always downloaded
+// and verified in a local staging directory first, and then committed
+// to the storage.
+//
+// Paths are slash-separated and relative to the root of the mirror,
+// like "amd64-usr/all/899.15.0/version.txt". Channel pointers like
+// "amd64-usr/stable/current" have targets relative to the directory
+// they are in, like "../all/899.15.0", just like symlinks.
+//
+// Storage must be safe for concurrent use.
+type Storage interface {
+	// Stage returns the local directory to download the files of
+	// the version directory dir into. It need not exist yet. Files
+	// there must not be visible in the storage before Commit, even
+	// if dir has been committed before.
+	Stage(ctx context.Context, dir string) (string, error)
+
+	// Commit publishes the files staged for dir. Files committed
+	// earlier are kept.
+	Commit(ctx context.Context, dir string) error
+
+	// Exists reports whether the file or directory p has been
+	// committed.
+	Exists(ctx context.Context, p string) (bool, error)
+
+	// List returns the names of the files committed in dir, or nil
+	// if there are none.
+	List(ctx context.Context, dir string) ([]string, error)
+
+	// Open reads a committed file.
+	Open(ctx context.Context, p string) (io.ReadCloser, error)
+
+	// Pointer returns the target of the pointer name, or "" if it
+	// does not exist.
+	Pointer(ctx context.Context, name string) (string, error)
+
+	// SetPointer makes the pointer name point to target, replacing
+	// it if it exists.
+	SetPointer(ctx context.Context, name, target string) error
+}
+
+// WithStorage keeps the mirror in s, instead of the destination
+// directory. The destination directory is still used for staging
+// downloads, caching and locking, so runs sharing a storage must also
+// share the destination directory to keep out of each other's way.
+// GC and Verify only work on the destination directory, and ignore
+// this option.
+func WithStorage(s Storage) Option {
+	return func(conf *config) error {
+		conf.storage = s
+		return nil
+	}
+}
+
+// fileStorage keeps the mirror in a local directory, with symlinks as
+// pointers. It is the default.
+//
+// Versions are staged in a hidden directory next to where they
+// belong. A new version is renamed into place when committed; files
+// added to a version committed earlier are renamed into it one by
+// one. Hidden files, like interrupted downloads, always stay staged.
+type fileStorage struct {
+	root string
+}
+
+func (s *fileStorage) path(p string) string {
+	return filepath.Join(s.root, filepath.FromSlash(p))
+}
+
+// stagingPath returns where the version directory dir is assembled
+// before it is committed.
+func (s *fileStorage) stagingPath(dir string) string {
+	parent, name := path.Split(dir)
+	return s.path(path.Join(parent, "."+name+stagingSuffix))
+}
+
+func (s *fileStorage) Stage(ctx context.Context, dir string) (string, error) {
+	return s.stagingPath(dir), nil
+}
+
+func (s *fileStorage) Commit(ctx context.Context, dir string) error {
+	staging := s.stagingPath(dir)
+	ok, err := s.Exists(ctx, dir)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		err := os.Rename(staging, s.path(dir))
+		if os.IsNotExist(err) {
+			// nothing staged
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// downloads in progress stay staged, to be resumed
+		return moveFiles(s.path(dir), staging, true)
+	}
+	if err := moveFiles(staging, s.path(dir), false); err != nil {
+		return err
+	}
+	// fails if there were hidden files
+	_ = os.Remove(staging)
+	return nil
+}
+
+// moveFiles renames the regular files in the directory from to the
+// directory to, creating it if needed. Only hidden files are moved if
+// hidden is true, and only the others if not.
+func moveFiles(from, to string, hidden bool) error {
+	fis, err := ioutil.ReadDir(from)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") != hidden {
+			continue
+		}
+		if err := os.MkdirAll(to, 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(from, fi.Name()), filepath.Join(to, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileStorage) Exists(ctx context.Context, p string) (bool, error) {
+	_, err := os.Stat(s.path(p))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *fileStorage) List(ctx context.Context, dir string) ([]string, error) {
+	fis, err := ioutil.ReadDir(s.path(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range fis {
+		// hidden files are downloads in progress
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		names = append(names, fi.Name())
+	}
+	return names, nil
+}
+
+func (s *fileStorage) Open(ctx context.Context, p string) (io.ReadCloser, error) {
+	return os.Open(s.path(p))
+}
+
+func (s *fileStorage) Pointer(ctx context.Context, name string) (string, error) {
+	target, err := os.Readlink(s.path(name))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return target, err
+}
+
+func (s *fileStorage) SetPointer(ctx context.Context, name, target string) error {
+	link := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		return err
+	}
+	return atomic.Symlink(target, link)
+}
+
+// committed returns the names of the files of the version in the
+// storage.
+func (m *mirrorer) committed(ctx context.Context, v *VersionPlan) (map[string]bool, error) {
+	names, err := m.storage.List(ctx, v.dir())
+	if err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set, nil
+}
+
+// open reads a file of the version from the staging directory, or if
+// it is not there, from the storage.
+func (m *mirrorer) open(ctx context.Context, v *VersionPlan, name string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(v.local, name))
+	if os.IsNotExist(err) {
+		return m.storage.Open(ctx, path.Join(v.dir(), name))
+	}
+	return f, err
+}
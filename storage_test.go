@@ -0,0 +1,67 @@
+package oppositus_test
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"eagain.net/go/oppositus"
+	"eagain.net/go/oppositus/channels"
+	"eagain.net/go/oppositus/internal/s3test"
+	"eagain.net/go/oppositus/s3"
+	"golang.org/x/net/context"
+)
+
+func TestMirrorS3(t *testing.T) {
+	srv := newUpstream(t, upstreamFiles(t))
+	defer srv.Close()
+	bucket := s3test.NewServer("mirror")
+	defer bucket.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	storage := &s3.Storage{
+		Endpoint:        bucket.URL,
+		Bucket:          bucket.Bucket,
+		Region:          s3test.Region,
+		AccessKeyID:     s3test.Credentials.AccessKeyID,
+		SecretAccessKey: s3test.Credentials.SecretAccessKey,
+		WorkDir:         dst,
+	}
+	mirror := func() {
+		_, err := oppositus.Mirror(context.Background(), dst,
+			oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+			oppositus.WithChannels(channels.Stable),
+			oppositus.WithStorage(storage),
+		)
+		if err != nil {
+			t.Fatalf("mirror: %v", err)
+		}
+	}
+	mirror()
+
+	want := []string{
+		"amd64-usr/all/" + testVersion + "/version.txt",
+		"amd64-usr/all/" + testVersion + "/version.txt.sig",
+		"amd64-usr/stable/" + testVersion,
+		"amd64-usr/stable/current",
+	}
+	if g := bucket.Keys(); !reflect.DeepEqual(g, want) {
+		t.Errorf("wrong keys: %q != %q", g, want)
+	}
+	obj, ok := bucket.Object("amd64-usr/stable/current")
+	if !ok {
+		t.Fatal("no current pointer")
+	}
+	if g, e := string(obj.Body), "../all/"+testVersion+"\n"; g != e {
+		t.Errorf("wrong current pointer: %q != %q", g, e)
+	}
+	if g, e := obj.Header.Get("X-Amz-Website-Redirect-Location"), "/amd64-usr/all/"+testVersion+"/"; g != e {
+		t.Errorf("wrong redirect: %q != %q", g, e)
+	}
+
+	mirror()
+	if g, e := srv.count("GET", "/stable/"+testVersion+"/version.txt"), 1; g != e {
+		t.Errorf("downloaded again: %d != %d", g, e)
+	}
+}
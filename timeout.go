@@ -0,0 +1,84 @@
+package oppositus
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// FileTimeoutError means a file took longer to download than allowed
+// with WithFileTimeout.
+type FileTimeoutError struct {
+	URL     *url.URL
+	Timeout time.Duration
+}
+
+func (e *FileTimeoutError) Error() string {
+	return fmt.Sprintf("download took longer than %v: %v", e.Timeout, e.URL)
+}
+
+// RunTimeoutError means mirroring took longer than allowed with
+// WithRunTimeout, and was aborted.
+type RunTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *RunTimeoutError) Error() string {
+	return fmt.Sprintf("mirroring took longer than %v", e.Timeout)
+}
+
+// WithIdleTimeout aborts a download if no data arrives for the given
+// time. The error is a *sig.StallError, and the download is resumed
+// if the retry policy allows. By default, there is no limit.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(conf *config) error {
+		if d <= 0 {
+			return fmt.Errorf("idle timeout must be positive: %v", d)
+		}
+		conf.idleTimeout = d
+		return nil
+	}
+}
+
+// WithFileTimeout limits how long downloading a file may take,
+// including retries. Time spent waiting for a free slot for the host
+// (see WithConcurrency) does not count. The error is a
+// *FileTimeoutError. By default, there is no limit.
+func WithFileTimeout(d time.Duration) Option {
+	return func(conf *config) error {
+		if d <= 0 {
+			return fmt.Errorf("file timeout must be positive: %v", d)
+		}
+		conf.fileTimeout = d
+		return nil
+	}
+}
+
+// WithRunTimeout limits how long mirroring may take, counting from
+// the start of Prepare to the end of Execute. When the time is up,
+// mirroring is aborted, and the error handler is passed a
+// *RunTimeoutError, which is also returned whatever the handler says.
+// By default, there is no limit.
+func WithRunTimeout(d time.Duration) Option {
+	return func(conf *config) error {
+		if d <= 0 {
+			return fmt.Errorf("run timeout must be positive: %v", d)
+		}
+		conf.runTimeout = d
+		return nil
+	}
+}
+
+// abortAt aborts mirroring with a *RunTimeoutError if it is still
+// going on at the deadline set with WithRunTimeout, counting from
+// start. The returned function must be called when done.
+func (m *mirrorer) abortAt(start time.Time) (stop func()) {
+	if m.conf.runTimeout == 0 {
+		return func() {}
+	}
+	left := time.Until(start.Add(m.conf.runTimeout))
+	t := time.AfterFunc(left, func() {
+		m.errs.abort(&RunTimeoutError{Timeout: m.conf.runTimeout})
+	})
+	return func() { t.Stop() }
+}
@@ -0,0 +1,93 @@
+package oppositus_test
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"eagain.net/go/oppositus"
+	"eagain.net/go/oppositus/channels"
+	"golang.org/x/net/context"
+)
+
+func TestMirrorFileTimeout(t *testing.T) {
+	srv := newUpstream(t, upstreamFiles(t))
+	defer srv.Close()
+	srv.hangOn("GET", "/stable/"+testVersion+"/version.txt")
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	var mu sync.Mutex
+	var errs []error
+	_, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+		oppositus.WithFileTimeout(100*time.Millisecond),
+		oppositus.WithErrorHandler(func(err error) error {
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, err)
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	err = assertNotPublished(t, dst, "amd64-usr", testVersion, errs)
+	if _, ok := err.(*oppositus.FileTimeoutError); !ok {
+		t.Errorf("wrong error: %v", err)
+	}
+}
+
+func TestMirrorFileTimeoutQueued(t *testing.T) {
+	files := upstreamFiles(t)
+	files["stable/"+testVersion+"/other.txt"] = files["stable/"+testVersion+"/version.txt"]
+	files["stable/"+testVersion+"/other.txt.sig"] = files["stable/"+testVersion+"/version.txt.sig"]
+	srv := newUpstream(t, files)
+	defer srv.Close()
+	srv.delay("GET", "/stable/"+testVersion+"/version.txt", 300*time.Millisecond)
+	srv.delay("GET", "/stable/"+testVersion+"/other.txt", 300*time.Millisecond)
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	// each file fits in the timeout, but not both one after the
+	// other
+	_, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+		oppositus.WithConcurrency(1),
+		oppositus.WithFileTimeout(500*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+}
+
+func TestMirrorRunTimeout(t *testing.T) {
+	srv := newUpstream(t, upstreamFiles(t))
+	defer srv.Close()
+	srv.hangOn("GET", "/stable/"+testVersion+"/version.txt")
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	var handled []error
+	_, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+		oppositus.WithRunTimeout(200*time.Millisecond),
+		oppositus.WithErrorHandler(func(err error) error {
+			handled = append(handled, err)
+			return nil
+		}),
+	)
+	if _, ok := err.(*oppositus.RunTimeoutError); !ok {
+		t.Fatalf("wrong error: %v", err)
+	}
+	if g, e := len(handled), 1; g != e {
+		t.Fatalf("wrong number of errors handled: %d != %d: %v", g, e, handled)
+	}
+	if handled[0] != err {
+		t.Errorf("error handler saw a different error: %v", handled[0])
+	}
+}
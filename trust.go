@@ -0,0 +1,29 @@
+package oppositus
+
+import (
+	"eagain.net/go/oppositus/sig"
+	"golang.org/x/crypto/openpgp"
+)
+
+// WithVerifier sets what signatures are trusted, when mirroring and
+// verifying. By default, only the CoreOS Image Signing Key is.
+func WithVerifier(v *sig.Verifier) Option {
+	return func(conf *config) error {
+		conf.verifier = v
+		return nil
+	}
+}
+
+// WithKeyring trusts the keys in keyring, instead of the CoreOS Image
+// Signing Key. To trust both, include sig.DefaultKeyring. For
+// validity windows and fingerprint checks, use WithVerifier.
+func WithKeyring(keyring openpgp.EntityList) Option {
+	return func(conf *config) error {
+		v, err := sig.NewVerifier(keyring)
+		if err != nil {
+			return err
+		}
+		conf.verifier = v
+		return nil
+	}
+}
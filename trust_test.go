@@ -0,0 +1,82 @@
+package oppositus_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"eagain.net/go/oppositus"
+	"eagain.net/go/oppositus/channels"
+	"eagain.net/go/oppositus/sig"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+	"golang.org/x/net/context"
+)
+
+func TestMirrorKeyring(t *testing.T) {
+	key, err := openpgp.NewEntity("Test Signing Key", "", "test@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := upstreamFiles(t)
+	var signature bytes.Buffer
+	version := files["stable/"+testVersion+"/version.txt"]
+	if err := openpgp.DetachSign(&signature, key, bytes.NewReader(version), nil); err != nil {
+		t.Fatal(err)
+	}
+	files["stable/"+testVersion+"/version.txt.sig"] = signature.Bytes()
+	srv := newUpstream(t, files)
+	defer srv.Close()
+
+	mirror := func(opts ...oppositus.Option) (string, []error) {
+		dst := tempDir(t)
+		var errs []error
+		opts = append(opts,
+			oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+			oppositus.WithChannels(channels.Stable),
+			oppositus.WithErrorHandler(func(err error) error {
+				errs = append(errs, err)
+				return nil
+			}),
+		)
+		if _, err := oppositus.Mirror(context.Background(), dst, opts...); err != nil {
+			t.Fatalf("mirror: %v", err)
+		}
+		return dst, errs
+	}
+
+	dst, errs := mirror()
+	os.RemoveAll(dst)
+	if len(errs) == 0 {
+		t.Fatal("signature by unknown key accepted")
+	}
+	if _, ok := errs[0].(*sig.SignatureError); !ok {
+		t.Errorf("expected signature error: %T: %v", errs[0], errs[0])
+	}
+
+	keyring := oppositus.WithKeyring(openpgp.EntityList{key})
+	dst, errs = mirror(keyring)
+	defer os.RemoveAll(dst)
+	if len(errs) > 0 {
+		t.Fatalf("mirror: %v", errs)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "amd64-usr", "all", testVersion, "version.txt")); err != nil {
+		t.Errorf("not mirrored: %v", err)
+	}
+
+	rep, err := oppositus.Verify(context.Background(), dst, keyring)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if len(rep.Problems) > 0 {
+		t.Errorf("unexpected problems: %v", rep.Problems)
+	}
+	rep, err = oppositus.Verify(context.Background(), dst)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if len(rep.Problems) != 1 || rep.Problems[0].Kind != oppositus.ProblemBadSignature {
+		t.Errorf("expected a bad signature: %v", rep.Problems)
+	}
+}
@@ -0,0 +1,339 @@
+package oppositus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"eagain.net/go/oppositus/digests"
+	"eagain.net/go/oppositus/sig"
+	"golang.org/x/net/context"
+)
+
+// ProblemKind tells what is wrong with a file in the mirror.
+type ProblemKind int
+
+// Problems Verify finds.
+const (
+	// ProblemBadSignature means a file does not match its signature.
+	ProblemBadSignature ProblemKind = iota + 1
+	// ProblemMissingSignature means a file has no signature, and no
+	// signed DIGESTS file covers it.
+	ProblemMissingSignature
+	// ProblemMissingFile means there is a signature without the file
+	// it signs.
+	ProblemMissingFile
+	// ProblemBadDigest means a file does not match a signed DIGESTS
+	// file, or the DIGESTS file cannot be parsed.
+	ProblemBadDigest
+	// ProblemDanglingSymlink means a symlink in a channel directory
+	// points to a version that is not there.
+	ProblemDanglingSymlink
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case ProblemBadSignature:
+		return "bad-signature"
+	case ProblemMissingSignature:
+		return "missing-signature"
+	case ProblemMissingFile:
+		return "missing-file"
+	case ProblemBadDigest:
+		return "bad-digest"
+	case ProblemDanglingSymlink:
+		return "dangling-symlink"
+	}
+	return fmt.Sprintf("ProblemKind(%d)", int(k))
+}
+
+// MarshalText uses the same names as String.
+func (k ProblemKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// Problem is something wrong with a file in the mirror.
+type Problem struct {
+	Path string
+	Kind ProblemKind
+	// Err tells more, if there is more to tell.
+	Err error
+}
+
+func (p Problem) String() string {
+	if p.Err == nil {
+		return fmt.Sprintf("%v: %v", p.Kind, p.Path)
+	}
+	return fmt.Sprintf("%v: %v: %v", p.Kind, p.Path, p.Err)
+}
+
+// MarshalJSON uses lowercase keys, and converts the error into a
+// string.
+func (p Problem) MarshalJSON() ([]byte, error) {
+	j := struct {
+		Path  string      `json:"path"`
+		Kind  ProblemKind `json:"kind"`
+		Error string      `json:"error,omitempty"`
+	}{
+		Path: p.Path,
+		Kind: p.Kind,
+	}
+	if p.Err != nil {
+		j.Error = p.Err.Error()
+	}
+	return json.Marshal(j)
+}
+
+// VerifyReport is the result of Verify.
+type VerifyReport struct {
+	// Files is how many files were checked, not counting
+	// signatures.
+	Files int
+	// Problems lists what is wrong. If empty, the mirror is fine.
+	Problems []Problem
+}
+
+// MarshalJSON uses lowercase keys.
+func (r VerifyReport) MarshalJSON() ([]byte, error) {
+	j := struct {
+		Files    int       `json:"files"`
+		Problems []Problem `json:"problems"`
+	}{
+		Files:    r.Files,
+		Problems: r.Problems,
+	}
+	if j.Problems == nil {
+		j.Problems = []Problem{}
+	}
+	return json.Marshal(j)
+}
+
+// Verify checks the mirror under dst again, as if the files had just
+// been downloaded. Every file is checked against its signature, and
+// the signed DIGESTS files covering it. Files without a signature
+// that no DIGESTS file covers, signatures without a file, and channel
+// symlinks that point to missing versions are also reported.
+//
+// Only the boards set with WithBoards are checked. Errors reading the
+// mirror are passed to the handler set with WithErrorHandler.
+func Verify(ctx context.Context, dst string, opts ...Option) (*VerifyReport, error) {
+	conf, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	release, err := lockDst(ctx, conf, dst, false)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	rep := &VerifyReport{}
+	for _, board := range conf.boards {
+		if err := verifyBoard(ctx, conf, rep, filepath.Join(dst, board)); err != nil {
+			if err := conf.errFn(err); err != nil {
+				return rep, err
+			}
+		}
+	}
+	return rep, nil
+}
+
+// verifyBoard checks the board directory dir.
+func verifyBoard(ctx context.Context, conf *config, rep *VerifyReport, dir string) error {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, fi := range fis {
+		if !fi.IsDir() || fi.Name() == "all" || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		if err := verifyChannel(rep, filepath.Join(dir, fi.Name())); err != nil {
+			return err
+		}
+	}
+
+	allPath := filepath.Join(dir, "all")
+	versions, err := ioutil.ReadDir(allPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, fi := range versions {
+		if !fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		if err := verifyVersion(ctx, conf, rep, filepath.Join(allPath, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyChannel looks for dangling symlinks in a channel directory.
+func verifyChannel(rep *VerifyReport, dir string) error {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if fi.Mode()&os.ModeSymlink == 0 || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		link := filepath.Join(dir, fi.Name())
+		if _, err := os.Stat(link); err != nil {
+			if !os.IsNotExist(err) {
+				return err
+			}
+			target, err := os.Readlink(link)
+			if err != nil {
+				return err
+			}
+			rep.Problems = append(rep.Problems, Problem{
+				Path: link,
+				Kind: ProblemDanglingSymlink,
+				Err:  fmt.Errorf("no such version: %v", target),
+			})
+		}
+	}
+	return nil
+}
+
+// verifyVersion checks the files of a version directory.
+func verifyVersion(ctx context.Context, conf *config, rep *VerifyReport, dir string) error {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	files := make(map[string]bool)
+	var names []string
+	for _, fi := range fis {
+		// hidden files are downloads in progress
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		files[fi.Name()] = true
+		names = append(names, fi.Name())
+	}
+
+	signed := make(map[string]bool)
+	var unsigned []string
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p := filepath.Join(dir, name)
+		if strings.HasSuffix(name, sigExt) {
+			if !files[strings.TrimSuffix(name, sigExt)] {
+				rep.Problems = append(rep.Problems, Problem{Path: p, Kind: ProblemMissingFile})
+			}
+			continue
+		}
+		rep.Files++
+		if !files[name+sigExt] {
+			unsigned = append(unsigned, name)
+			continue
+		}
+		err := checkFile(conf.verifier, p, p+sigExt)
+		switch err.(type) {
+		case nil:
+			signed[name] = true
+		case *sig.SignatureError:
+			rep.Problems = append(rep.Problems, Problem{Path: p, Kind: ProblemBadSignature, Err: err})
+		default:
+			return err
+		}
+	}
+
+	// only trust DIGESTS files with good signatures
+	covered := make(map[string]bool)
+	for _, name := range names {
+		if !signed[name] || !strings.HasSuffix(name, digestsSuffix) {
+			continue
+		}
+		p := filepath.Join(dir, name)
+		d, err := readDigestsFile(p)
+		if err != nil {
+			rep.Problems = append(rep.Problems, Problem{Path: p, Kind: ProblemBadDigest, Err: err})
+			continue
+		}
+		for _, listed := range d.Names() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if !files[listed] {
+				continue
+			}
+			covered[listed] = true
+			if err := checkDigestFile(d, filepath.Join(dir, listed)); err != nil {
+				if _, ok := err.(*digests.MismatchError); !ok {
+					return err
+				}
+				rep.Problems = append(rep.Problems, Problem{
+					Path: filepath.Join(dir, listed),
+					Kind: ProblemBadDigest,
+					Err:  fmt.Errorf("%v: %v", name, err),
+				})
+			}
+		}
+	}
+
+	for _, name := range unsigned {
+		if !covered[name] {
+			rep.Problems = append(rep.Problems, Problem{Path: filepath.Join(dir, name), Kind: ProblemMissingSignature})
+		}
+	}
+	return nil
+}
+
+// checkFile checks a file against its signature, with the default
+// verifier if v is nil. A bad signature is a *sig.SignatureError.
+func checkFile(v *sig.Verifier, p, sigPath string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s, err := os.Open(sigPath)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if v == nil {
+		v = &sig.Verifier{}
+	}
+	if err := v.Check(f, s); err != nil {
+		return &sig.SignatureError{URL: &url.URL{Scheme: "file", Path: filepath.ToSlash(p)}, Err: err}
+	}
+	return nil
+}
+
+func readDigestsFile(p string) (digests.Digests, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	d, err := digests.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", p, err)
+	}
+	return d, nil
+}
+
+func checkDigestFile(d digests.Digests, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return d.Verify(filepath.Base(p), f)
+}
@@ -0,0 +1,155 @@
+package oppositus_test
+
+import (
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"eagain.net/go/oppositus"
+	"eagain.net/go/oppositus/channels"
+	"golang.org/x/net/context"
+)
+
+type problem struct {
+	Path string
+	Kind oppositus.ProblemKind
+}
+
+func TestVerify(t *testing.T) {
+	srv := newUpstream(t, upstreamFiles(t))
+	defer srv.Close()
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+
+	if _, err := oppositus.Mirror(context.Background(), dst,
+		oppositus.WithBaseURL(srv.URL+"/{channel}/"),
+		oppositus.WithChannels(channels.Stable),
+	); err != nil {
+		t.Fatalf("mirror: %v", err)
+	}
+	board := filepath.Join(dst, "amd64-usr")
+	verPath := filepath.Join(board, "all", testVersion)
+	extra := []byte("covered\n")
+	sum := sha512.Sum512(extra)
+	// the DIGESTS file cannot be signed here, so it vouches for
+	// nothing
+	for name, content := range map[string][]byte{
+		"version.txt.DIGESTS": []byte(fmt.Sprintf("# SHA512 HASH\n%x  extra.txt\n", sum)),
+		"extra.txt":           extra,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(verPath, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	verify := func() []problem {
+		var errs []error
+		rep, err := oppositus.Verify(context.Background(), dst,
+			oppositus.WithErrorHandler(func(err error) error {
+				errs = append(errs, err)
+				return nil
+			}),
+		)
+		if err != nil {
+			t.Fatalf("verify: %v", err)
+		}
+		if len(errs) != 0 {
+			t.Fatalf("unexpected errors: %v", errs)
+		}
+		var got []problem
+		for _, p := range rep.Problems {
+			rel, err := filepath.Rel(dst, p.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, problem{Path: filepath.ToSlash(rel), Kind: p.Kind})
+		}
+		return got
+	}
+
+	rel := "amd64-usr/all/" + testVersion + "/"
+	if g, e := verify(), []problem{
+		{Path: rel + "extra.txt", Kind: oppositus.ProblemMissingSignature},
+		{Path: rel + "version.txt.DIGESTS", Kind: oppositus.ProblemMissingSignature},
+	}; !reflect.DeepEqual(g, e) {
+		t.Errorf("wrong problems: %v != %v", g, e)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(verPath, "version.txt"), []byte("evil\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(verPath, "version.txt.sig")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(verPath, "other.txt.sig"), []byte("orphan"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../all/1.2.3", filepath.Join(board, "stable", "1.2.3")); err != nil {
+		t.Fatal(err)
+	}
+	if g, e := verify(), []problem{
+		{Path: "amd64-usr/stable/1.2.3", Kind: oppositus.ProblemDanglingSymlink},
+		{Path: rel + "other.txt.sig", Kind: oppositus.ProblemMissingFile},
+		{Path: rel + "extra.txt", Kind: oppositus.ProblemMissingSignature},
+		{Path: rel + "version.txt", Kind: oppositus.ProblemMissingSignature},
+		{Path: rel + "version.txt.DIGESTS", Kind: oppositus.ProblemMissingSignature},
+	}; !reflect.DeepEqual(g, e) {
+		t.Errorf("wrong problems: %v != %v", g, e)
+	}
+}
+
+func TestVerifyBadSignature(t *testing.T) {
+	dst := tempDir(t)
+	defer os.RemoveAll(dst)
+	verPath := filepath.Join(dst, "amd64-usr", "all", testVersion)
+	if err := os.MkdirAll(verPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string][]byte{
+		"version.txt":     []byte("evil\n"),
+		"version.txt.sig": readTestdata(t, "version.txt.sig"),
+	} {
+		if err := ioutil.WriteFile(filepath.Join(verPath, name), content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rep, err := oppositus.Verify(context.Background(), dst)
+	if err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if g, e := rep.Files, 1; g != e {
+		t.Errorf("wrong number of files: %d != %d", g, e)
+	}
+	if len(rep.Problems) != 1 {
+		t.Fatalf("wrong problems: %v", rep.Problems)
+	}
+	if g, e := rep.Problems[0].Kind, oppositus.ProblemBadSignature; g != e {
+		t.Errorf("wrong kind: %v != %v", g, e)
+	}
+	buf, err := json.Marshal(rep)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var j struct {
+		Files    int
+		Problems []struct {
+			Path  string
+			Kind  string
+			Error string
+		}
+	}
+	if err := json.Unmarshal(buf, &j); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	if g, e := j.Problems[0].Kind, "bad-signature"; g != e {
+		t.Errorf("wrong JSON kind: %q != %q", g, e)
+	}
+	if j.Problems[0].Error == "" {
+		t.Errorf("JSON lacks error: %s", buf)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
 
 	"github.com/google/shlex"
@@ -51,3 +52,41 @@ func ParseVersionID(r io.Reader) (string, error) {
 	}
 	return "", errors.New("version ID not found")
 }
+
+// Compare compares two version IDs such as "899.15.0" and
+// "1010.3.0". The result is negative if a is older than b, positive
+// if it is newer, and zero if they are equal.
+//
+// Dot-separated parts are compared numerically where possible, and
+// as strings otherwise.
+func Compare(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if c := comparePart(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+	return len(as) - len(bs)
+}
+
+func comparePart(a, b string) int {
+	an, aerr := strconv.ParseUint(a, 10, 64)
+	bn, berr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aerr == nil && berr == nil:
+		switch {
+		case an < bn:
+			return -1
+		case an > bn:
+			return 1
+		}
+		return 0
+	case aerr == nil:
+		// numbers sort before anything else
+		return -1
+	case berr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
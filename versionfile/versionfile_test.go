@@ -70,3 +70,31 @@ func TestParseVersionIDReadError(t *testing.T) {
 		t.Errorf("wrong error: %q != %q", g, e)
 	}
 }
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"899.15.0", "899.15.0", 0},
+		{"899.15.0", "899.17.0", -1},
+		{"899.17.0", "1010.3.0", -1},
+		{"1010.3.0", "899.17.0", 1},
+		{"1010.3", "1010.3.0", -1},
+		{"1010.3.0", "1010.x.0", -1},
+		{"1010.a.0", "1010.b.0", -1},
+	}
+
+	for _, test := range tests {
+		got := versionfile.Compare(test.a, test.b)
+		switch {
+		case got < 0:
+			got = -1
+		case got > 0:
+			got = 1
+		}
+		if g, e := got, test.want; g != e {
+			t.Errorf("Compare(%q, %q) = %d, want %d", test.a, test.b, g, e)
+		}
+	}
+}